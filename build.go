@@ -1,10 +1,14 @@
 package mmk
 
 import (
+	"bytes"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
-	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -15,6 +19,10 @@ import (
 
 var Verbose bool
 
+// Explain makes Build log which rule was chosen for each node, and why the
+// node is or is not built.
+var Explain bool
+
 // Exists reports whether the named file or directory exists.
 func fileExists(name string) bool {
 	if _, err := os.Stat(name); err != nil {
@@ -28,18 +36,82 @@ func fileExists(name string) bool {
 type Node struct {
 	Target   string
 	RuleType string
+	// Dir is the directory the node's rule body runs in, and that Target
+	// is relative to. It is empty for the current directory.
+	Dir      string
 	RuleSet  *RuleSet
 	Incoming map[string]*Node
 	Outgoing map[string]*Node
-	Vars     []*Var
-	visited  bool
-	queued   bool
+	// OrderOnly holds the keys of the Outgoing nodes that are order-only
+	// dependencies. They are built before the node, but do not make it
+	// stale.
+	OrderOnly map[string]bool
+	Vars      *Vars
+	Executor  Executor
+	// inherited holds the variables passed on to the node by the first
+	// node that reached it, whose key is inheritedFrom.
+	inherited     []*Var
+	inheritedFrom string
+	// inherit holds the variables the node passes on to its dependencies.
+	inherit []*Var
+	// prefix is the prefix of the namespace the node's target is in.
+	prefix string
+	// explain says which rule was chosen for the node, and why.
+	explain string
+	// stale, if not empty, says why the node must be built regardless of
+	// its build date.
+	stale string
+	// source is set for existing files that no rule makes.
+	source bool
+	// dynamic holds the dependencies printed by the node's deps rule,
+	// which is only run once.
+	dynamic    []depRef
+	dynamicRun bool
+	visited    bool
+	queued     bool
 
 	sync.Mutex
 	built    chan struct{}
 	buildErr error
 }
 
+// Name returns the node's target, including its namespace.
+func (n *Node) Name() string {
+	return n.prefix + n.Target
+}
+
+// key returns the node's key in the graph, "target:ruletype".
+func (n *Node) key() string {
+	return n.Name() + ":" + n.RuleType
+}
+
+// lookup returns the value of the variable name for the node, including
+// $target and the $match_N variables of its rule.
+func (n *Node) lookup(name string) string {
+	if name == "target" {
+		return n.Target
+	}
+	if m := matchVar.FindStringSubmatch(name); m != nil {
+		i, _ := strconv.Atoi(m[1])
+		if strs := n.RuleSet.Target.Captures(n.Target); i < len(strs) {
+			return strs[i]
+		}
+	}
+	return n.Vars.Get(name)
+}
+
+// path returns the path of the node's target.
+func (n *Node) path() string {
+	return n.pathOf(n.Target)
+}
+
+func (n *Node) pathOf(target string) string {
+	if n.Dir == "" || filepath.IsAbs(target) {
+		return target
+	}
+	return filepath.Join(n.Dir, target)
+}
+
 func (n *Node) Wait() error {
 	<-n.built
 	return n.buildErr
@@ -64,61 +136,56 @@ type deps struct {
 
 var depParser = participle.MustBuild(&deps{}, participle.Lexer(depLex))
 
-func fileRuleSet(target string) *RuleSet {
-	return &RuleSet{Target: &Matcher{Str: target}, Bodies: []*RuleBody{{Dependencies: make([]string, 0), Lines: make([]string, 0)}}}
+// A depRef is a single dependency of a node.
+type depRef struct {
+	target    string
+	ruleType  string
+	orderOnly bool
+	// discovered is set for dependencies read from a depfile in an
+	// earlier build.
+	discovered bool
 }
 
-func (r *RuleSets) BuildGraph(target, ruleType string, depchain []string, graph map[string]*Node) (*Node, error) {
-	// log.Printf("depchain: %#v\n", depchain)
-	for _, dep := range depchain {
-		if dep == target {
-			return nil, fmt.Errorf("Found dependency cycle: %s", strings.Join(depchain, " -> ")+" -> "+target)
+// orderOnlySep separates a rule's normal dependencies from its order-only
+// dependencies, which are built first but do not make the rule stale.
+const orderOnlySep = "|"
+
+// splitOrderOnly splits a rule's dependencies into normal and order-only
+// dependencies.
+func splitOrderOnly(deps []string) ([]string, []string) {
+	for i, d := range deps {
+		if d == orderOnlySep {
+			return deps[:i], deps[i+1:]
 		}
 	}
-	rule := r.RuleFor(target, ruleType)
-	if rule == nil {
-		if ruleType == "" && fileExists(target) {
-			// 			if Verbose {
-			// 				log.Printf("No rule found for %s, but found file with same name.", target)
-			// 			}
-			rule = fileRuleSet(target)
+	return deps, nil
+}
+
+// expandDeps expands a rule's dependencies to depRefs of ruleType, unless
+// they say otherwise. captures holds the target's capture groups, for
+// templates, and lookup looks up other variables.
+func (r *RuleSets) expandDeps(list []string, ruleType string, captures []string, lookup func(string) string) ([]depRef, error) {
+	// Single-quoted dependencies are templates, which are expanded on their
+	// own. The rest are expanded together, since function calls can span
+	// several of them.
+	var plain, templates []string
+	for _, d := range list {
+		if strings.HasPrefix(d, "'") {
+			templates = append(templates, d)
 		} else {
-			targetrule := target
-			if ruleType != "" {
-				targetrule += ":" + ruleType
-			}
-			return nil, fmt.Errorf("No such target %s for dependency chain %s", targetrule, strings.Join(append(depchain, targetrule), " -> "))
+			plain = append(plain, d)
 		}
 	}
-	node, ok := graph[target+":"+ruleType]
-	if !ok {
-		node = &Node{
-			Target:   target,
-			RuleType: ruleType,
-			RuleSet:  rule,
-			Incoming: make(map[string]*Node),
-			Outgoing: make(map[string]*Node),
-			Vars:     r.Vars,
-			built:    make(chan struct{}),
+	dependencystr := strings.Join(plain, " ")
+	var expandErr error
+	dependencystr = expandText(dependencystr, lookup, func(err error) {
+		if expandErr == nil {
+			expandErr = err
 		}
-		graph[target+":"+ruleType] = node
-	}
-
-	body := rule.SelectBody(ruleType)
-
-	vars := make(map[string]string)
-	for _, v := range r.Vars {
-		vars[v.Name] = strings.Join(v.Value, " ")
-	}
-	strs := node.RuleSet.Target.Captures(node.Target)
-	for i, s := range strs {
-		vars[fmt.Sprintf("match_%d", i)] = s
-	}
-	vars["target"] = node.Target
-	dependencystr := strings.Join(body.Dependencies, " ")
-	dependencystr = os.Expand(dependencystr, func(s string) string {
-		return vars[s]
 	})
+	if expandErr != nil {
+		return nil, expandErr
+	}
 
 	var ds deps
 	err := depParser.ParseString("", dependencystr, &ds)
@@ -126,15 +193,292 @@ func (r *RuleSets) BuildGraph(target, ruleType string, depchain []string, graph
 		log.Printf("Failed to parse dependencies: %s", err)
 	}
 
-	dc := append(depchain, target+":"+ruleType)
+	refs, err := resolveDeps(ds.Deps, ruleType, r.Dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, t := range templates {
+		d, err := expandTemplate(t, captures, lookup)
+		if err != nil {
+			return nil, err
+		}
+		refs = append(refs, depRef{target: d, ruleType: ruleType})
+	}
+	return refs, nil
+}
 
-	for _, dep := range ds.Deps {
-		depTarget := strings.Trim(dep.Target, `"`)
+// resolveDeps converts parsed dependencies to depRefs. Dependencies that
+// are unquoted glob patterns are replaced by the files in dir that they
+// match. Patterns that match no files are kept as they are, so they may
+// still name a rule.
+func resolveDeps(ds []*dep, ruleType, dir string) ([]depRef, error) {
+	var refs []depRef
+	for _, dep := range ds {
 		rt := ruleType
 		if dep.Colon != "" {
 			rt = dep.RuleType
 		}
-		depnode, err := r.BuildGraph(depTarget, rt, dc, graph)
+		if !strings.HasPrefix(dep.Target, `"`) && isGlob(dep.Target) {
+			pattern := dep.Target
+			if dir != "" && !filepath.IsAbs(pattern) {
+				pattern = filepath.Join(dir, pattern)
+			}
+			matches, err := glob(pattern)
+			if err != nil {
+				return nil, err
+			}
+			for _, m := range matches {
+				if pattern != dep.Target {
+					m, _ = filepath.Rel(dir, m)
+				}
+				refs = append(refs, depRef{target: m, ruleType: rt})
+			}
+			if len(matches) > 0 {
+				continue
+			}
+		}
+		refs = append(refs, depRef{target: strings.Trim(dep.Target, `"`), ruleType: rt})
+	}
+	return refs, nil
+}
+
+// expandTemplate expands a dependency template, written in single quotes.
+// $N and ${N} are replaced with capture group N of the target's regular
+// expression, and $$ with $. Other references are expanded with lookup.
+// The result is a single dependency, whatever it contains.
+func expandTemplate(t string, captures []string, lookup func(string) string) (string, error) {
+	var err error
+	d := expandText(strings.Trim(t, "'"), func(name string) string {
+		if name == "$" {
+			return "$"
+		}
+		n, convErr := strconv.Atoi(name)
+		if convErr != nil {
+			return lookup(name)
+		}
+		if n >= len(captures) {
+			if err == nil {
+				err = fmt.Errorf("%s refers to capture group %d, which the target does not have", t, n)
+			}
+			return ""
+		}
+		return captures[n]
+	}, func(e error) {
+		if err == nil {
+			err = e
+		}
+	})
+	return d, err
+}
+
+func fileRuleSet(target string) *RuleSet {
+	return &RuleSet{Target: &Matcher{Str: target}, Bodies: []*RuleBody{{Dependencies: make([]string, 0), Lines: make([]string, 0)}}}
+}
+
+// nodeVars returns the variables for target, which is built by body, and
+// the variables that target passes on to its dependencies. inherited holds
+// the variables passed on to target by the node that depends on it.
+func (r *RuleSets) nodeVars(target string, body *RuleBody, inherited []*Var) (*Vars, []*Var) {
+	var defs []*Var
+	inherit := inherited
+	defs = append(defs, inherited...)
+	defs = append(defs, body.Vars...)
+	for _, tv := range r.TargetVars {
+		if tv.Target.Matches(target) {
+			defs = append(defs, tv.Var)
+			if tv.Inherit {
+				inherit = append(inherit[:len(inherit):len(inherit)], tv.Var)
+			}
+		}
+	}
+	if len(defs) == 0 {
+		return r.Vars, nil
+	}
+	vs := r.Vars.Scope()
+	for _, v := range defs {
+		vs.Define(v)
+	}
+	return vs, inherit
+}
+
+// checkInherited reports an error if inherited, the variables passed on to
+// node by the last node of depchain, give a variable a different value
+// than those node was built with. The node is only built once, so it
+// cannot have both.
+func (r *RuleSets) checkInherited(node *Node, inherited []*Var, depchain []string) error {
+	if sameVars(node.inherited, inherited) {
+		return nil
+	}
+	first, second := r.Vars.Scope(), r.Vars.Scope()
+	names := make(map[string]struct{})
+	for _, v := range node.inherited {
+		first.Define(v)
+		names[v.Name] = struct{}{}
+	}
+	for _, v := range inherited {
+		second.Define(v)
+	}
+	for _, v := range inherited {
+		if _, ok := names[v.Name]; !ok {
+			continue
+		}
+		// Variables are only inherited from other nodes, so depchain
+		// is not empty.
+		if a, b := first.Get(v.Name), second.Get(v.Name); a != b {
+			return fmt.Errorf("%s inherits conflicting values of %s: %q from %s and %q from %s", node.key(), v.Name, a, node.inheritedFrom, b, depchain[len(depchain)-1])
+		}
+	}
+	return nil
+}
+
+func sameVars(a, b []*Var) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// hasRuleType reports whether the list of alternative rule types ruleType
+// includes t.
+func hasRuleType(ruleType, t string) bool {
+	for _, alt := range strings.Split(ruleType, "|") {
+		if alt == t {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *RuleSets) BuildGraph(target, ruleType string, depchain []string, graph map[string]*Node) (*Node, error) {
+	return r.buildGraph(target, ruleType, depchain, graph, nil)
+}
+
+func (r *RuleSets) buildGraph(target, ruleType string, depchain []string, graph map[string]*Node, inherited []*Var) (*Node, error) {
+	ns, local, err := r.namespaceFor(target)
+	if err != nil {
+		return nil, err
+	}
+	if ns != r {
+		return ns.buildGraph(local, ruleType, depchain, graph, inherited)
+	}
+	name := r.Prefix + target
+	rule, selected := r.ruleFor(target, ruleType, false)
+	var explanation string
+	var source bool
+	if rule != nil {
+		explanation = fmt.Sprintf("using rule %s at %s", rule.Target, rule.Pos)
+	} else if hasRuleType(ruleType, "") && fileExists(r.path(target)) {
+		// 			if Verbose {
+		// 				log.Printf("No rule found for %s, but found file with same name.", target)
+		// 			}
+		rule = fileRuleSet(target)
+		source = true
+		explanation = "using the existing file, since no rule matches"
+	} else if rule, selected = r.ruleFor(target, ruleType, true); rule != nil {
+		what := "fallback rule " + rule.Target.String()
+		if rule == r.Default {
+			what = "the " + defaultTarget + " rule"
+		}
+		explanation = fmt.Sprintf("using %s at %s, since no other rule matches and the file does not exist", what, rule.Pos)
+	} else {
+		targetrule := name
+		if ruleType != "" {
+			targetrule += ":" + ruleType
+		}
+		return nil, fmt.Errorf("No such target %s for dependency chain %s", targetrule, strings.Join(append(depchain, targetrule), " -> "))
+	}
+	if group := rule.Target.Group; group != nil {
+		// Every target of a group is built by the node of its first.
+		target = group[0]
+		name = r.Prefix + target
+	}
+	key := name + ":" + selected
+	// log.Printf("depchain: %#v\n", depchain)
+	for _, dep := range depchain {
+		if dep == key {
+			return nil, fmt.Errorf("Found dependency cycle: %s", strings.Join(depchain, " -> ")+" -> "+key)
+		}
+	}
+	node, ok := graph[key]
+	if !ok {
+		vars, inherit := r.nodeVars(target, rule.SelectBody(selected), inherited)
+		node = &Node{
+			Target:    target,
+			RuleType:  selected,
+			RuleSet:   rule,
+			Incoming:  make(map[string]*Node),
+			Outgoing:  make(map[string]*Node),
+			OrderOnly: make(map[string]bool),
+			Dir:       r.Dir,
+			Vars:      vars,
+			Executor:  r.executor(),
+			inherit:   inherit,
+			inherited: inherited,
+			prefix:    r.Prefix,
+			explain:   explanation,
+			source:    source,
+			built:     make(chan struct{}),
+		}
+		if len(depchain) > 0 {
+			node.inheritedFrom = depchain[len(depchain)-1]
+		}
+		graph[key] = node
+		for _, g := range rule.Target.Group {
+			graph[r.Prefix+g+":"+selected] = node
+		}
+	} else if err := r.checkInherited(node, inherited, depchain); err != nil {
+		return nil, err
+	}
+
+	body := rule.SelectBody(selected)
+
+	strs := node.RuleSet.Target.Captures(node.Target)
+	lookup := node.lookup
+	dc := append(depchain, key)
+
+	normal, orderOnly := splitOrderOnly(body.Dependencies)
+	refs, err := r.expandDeps(normal, ruleType, strs, lookup)
+	if err != nil {
+		return nil, fmt.Errorf("Bad dependency for %s: %s", target, err)
+	}
+	orefs, err := r.expandDeps(orderOnly, ruleType, strs, lookup)
+	if err != nil {
+		return nil, fmt.Errorf("Bad dependency for %s: %s", target, err)
+	}
+	for i := range orefs {
+		orefs[i].orderOnly = true
+	}
+	refs = append(refs, orefs...)
+	if selected != "deps" {
+		dyn, err := node.dynamicDeps(ruleType)
+		if err != nil {
+			return nil, err
+		}
+		refs = append(refs, dyn...)
+	}
+	if body.Depfile != "" {
+		for _, d := range loadState().deps(key) {
+			refs = append(refs, depRef{target: d, discovered: true})
+		}
+	}
+	for _, ref := range refs {
+		depTarget, rt := ref.target, ref.ruleType
+		depnode, err := r.buildGraph(depTarget, rt, dc, graph, node.inherit)
+		if err != nil && ref.discovered {
+			// The dependency was removed since the depfile was
+			// written. Building the node again will find out what it
+			// depends on now.
+			if Verbose {
+				log.Printf("Discovered dependency %s of %s is gone: %s", depTarget, node.Name(), err)
+			}
+			node.stale = fmt.Sprintf("discovered dependency %s no longer exists", depTarget)
+			continue
+		}
 		if err != nil {
 			if body.FailOK {
 				if Verbose {
@@ -149,8 +493,16 @@ func (r *RuleSets) BuildGraph(target, ruleType string, depchain []string, graph
 			// Non-node dependency (file present)
 			continue
 		}
-		depnode.Incoming[target+":"+ruleType] = node
-		node.Outgoing[depTarget+":"+rt] = depnode
+		depkey := depnode.Name() + ":" + depnode.RuleType
+		depnode.Incoming[key] = node
+		if ref.orderOnly {
+			if _, ok := node.Outgoing[depkey]; !ok {
+				node.OrderOnly[depkey] = true
+			}
+		} else {
+			delete(node.OrderOnly, depkey)
+		}
+		node.Outgoing[depkey] = depnode
 	}
 	//log.Printf("%s:%s RETURNING NODE: %v", target, ruleType, node)
 	return node, nil
@@ -176,16 +528,45 @@ func FindRoots(n *Node, roots []*Node) []*Node {
 
 type Graph struct {
 	roots []*Node
+	// nodes holds the graph's nodes by key. A grouped rule's node is
+	// held once for each of its targets.
+	nodes map[string]*Node
+}
+
+// A Goal is a target to build with each of a list of rule types.
+type Goal struct {
+	Target    string
+	RuleTypes []string
 }
 
 func GenerateGraph(rs *RuleSets, target, ruleType string) (*Graph, error) {
+	return GenerateGraphForTypes(rs, target, []string{ruleType})
+}
+
+// GenerateGraphForTypes generates a single graph that builds target with
+// each of the rule types in ruleTypes.
+func GenerateGraphForTypes(rs *RuleSets, target string, ruleTypes []string) (*Graph, error) {
+	return GenerateGraphForGoals(rs, []Goal{{Target: target, RuleTypes: ruleTypes}})
+}
+
+// GenerateGraphForGoals generates a single graph that builds every goal.
+func GenerateGraphForGoals(rs *RuleSets, goals []Goal) (*Graph, error) {
 	graph := make(map[string]*Node)
-	start, err := rs.BuildGraph(target, ruleType, []string{}, graph)
-	if err != nil {
-		return nil, err
+	var starts []*Node
+	for _, goal := range goals {
+		for _, ruleType := range goal.RuleTypes {
+			start, err := rs.BuildGraph(goal.Target, ruleType, []string{}, graph)
+			if err != nil {
+				return nil, err
+			}
+			starts = append(starts, start)
+		}
 	}
-	roots := FindRoots(start, nil)
-	return &Graph{roots}, nil
+	var roots []*Node
+	for _, start := range starts {
+		roots = FindRoots(start, roots)
+	}
+	return &Graph{roots: roots, nodes: graph}, nil
 }
 
 func (g *Graph) Execute(njobs int) error {
@@ -214,12 +595,40 @@ func (g *Graph) Execute(njobs int) error {
 	// 	return nil
 }
 
-func addHeader(body string) string {
+// bashArrays returns bash declarations of an array named name_list for
+// each variable in env, which is in "name=value" form. The array holds the
+// variable's value split into words, as splitWords does.
+func bashArrays(env []string) string {
+	var b strings.Builder
+	for _, e := range env {
+		i := strings.Index(e, "=")
+		name := e[:i]
+		if !isVarName(name) {
+			continue
+		}
+		b.WriteString("declare -a " + name + "_list=(")
+		for j, w := range splitWords(e[i+1:]) {
+			if j > 0 {
+				b.WriteByte(' ')
+			}
+			b.WriteString(bashQuote(w))
+		}
+		b.WriteString(")\n")
+	}
+	return b.String()
+}
+
+// bashQuote quotes s as a single bash word.
+func bashQuote(s string) string {
+	return "'" + strings.ReplaceAll(s, "'", `'\''`) + "'"
+}
+
+func addHeader(arrays, body string) string {
 	ret := `
 set -o errexit
 set -o nounset
 set -o pipefail
-`
+` + arrays
 	if Verbose {
 		ret += `set -x
 `
@@ -236,69 +645,163 @@ function mmkecho {
 	return ret
 }
 
-func (n *Node) run() error {
-	// NOT PROTECTED BY A LOCK (should be run from Build())
-	body := n.RuleSet.SelectBody(n.RuleType)
-	execBody := strings.Join(body.Lines, "\n")
-	cmd := exec.Command("bash", "-s")
-	var vars []string
-	for _, v := range n.Vars {
-		vars = append(vars, fmt.Sprintf("%s=%s", v.Name, strings.Join(v.Value, " ")))
+// script prepares body to be run on behalf of n. Variables defined with
+// "=" are only evaluated and exported if a bash body refers to them, so
+// that their shell commands do not run for every body. Bodies run by other
+// interpreters are given every variable.
+func (n *Node) script(body *RuleBody) *Script {
+	var used func(string) bool
+	if len(body.Interpreter) == 0 {
+		text := strings.Join(body.Lines, "\n")
+		used = func(name string) bool {
+			return regexp.MustCompile(`\$\{?#?` + regexp.QuoteMeta(name) + `\b`).MatchString(text)
+		}
 	}
+	vars := n.Vars.environ(used)
+	arrays := bashArrays(vars)
 	strs := n.RuleSet.Target.Captures(n.Target)
 	for i, s := range strs {
 		vars = append(vars, fmt.Sprintf("match_%d=%s", i, s))
 	}
+	vars = append(vars, fmt.Sprintf("%s=%s", mmkVarsEnv, strings.Join(n.Vars.mmkfileNames(), " ")))
 	vars = append(vars, fmt.Sprintf("mmk_ruletype=%s", n.RuleType))
 	vars = append(vars, fmt.Sprintf("target=%s", n.Target))
-	cmd.Env = append(os.Environ(), vars...)
-	cmd.Stdin = strings.NewReader(addHeader(execBody))
+	if group := n.RuleSet.Target.Group; group != nil {
+		vars = append(vars, fmt.Sprintf("targets=%s", strings.Join(group, " ")))
+	}
+	s := &Script{
+		Dir:         n.Dir,
+		Env:         vars,
+		Echo:        os.Stderr,
+		Interpreter: body.Interpreter,
+	}
+	if len(body.Interpreter) == 0 {
+		s.Body = addHeader(arrays, strings.Join(body.Lines, "\n"))
+	} else {
+		s.Body = strings.Join(body.Lines, "\n") + "\n"
+	}
+	return s
+}
+
+func (n *Node) executor() Executor {
+	if n.Executor != nil {
+		return n.Executor
+	}
+	return DefaultExecutor
+}
+
+func (n *Node) run() error {
+	// NOT PROTECTED BY A LOCK (should be run from Build())
+	body := n.RuleSet.SelectBody(n.RuleType)
+	s := n.script(body)
 	if Verbose {
-		cmd.Stdout = os.Stdout
-		cmd.Stderr = os.Stderr
+		s.Stdout = os.Stdout
+		s.Stderr = os.Stderr
 	}
-	cmd.ExtraFiles = []*os.File{os.Stderr}
-	if err := cmd.Run(); err != nil && !body.FailOK {
+	if err := n.executor().Execute(s); err != nil && !body.FailOK {
 		log.Printf("RUN ERROR: %s", err)
-		return fmt.Errorf("Failed to execute target: %s: %s", n.Target, err)
+		return fmt.Errorf("Failed to execute target: %s: %s", n.Name(), err)
 	}
 	return nil
 }
 
+// dynamicDeps runs the node's deps rule, if it has one, and returns the
+// dependencies it prints, which are of ruleType unless they say otherwise.
+// The rule is run while the graph is built, before any of the node's
+// dependencies are.
+func (n *Node) dynamicDeps(ruleType string) ([]depRef, error) {
+	if n.dynamicRun {
+		return n.dynamic, nil
+	}
+	n.dynamicRun = true
+	for _, body := range n.RuleSet.Bodies {
+		if body.RuleType != "deps" {
+			continue
+		}
+		var output bytes.Buffer
+		s := n.script(body)
+		s.Stdout = &output
+		if Verbose {
+			s.Stderr = os.Stderr
+		}
+		if err := n.executor().Execute(s); err != nil {
+			return nil, fmt.Errorf("Failed to run deps rule for %s: %s", n.Name(), err)
+		}
+		var ds deps
+		if err := depParser.ParseString("", output.String(), &ds); err != nil {
+			return nil, fmt.Errorf("Failed to parse output of deps rule for %s: %s", n.Name(), err)
+		}
+		refs, err := resolveDeps(ds.Deps, ruleType, n.Dir)
+		if err != nil {
+			return nil, fmt.Errorf("Bad dependency from deps rule for %s: %s", n.Name(), err)
+		}
+		n.dynamic = refs
+		break
+	}
+	return n.dynamic, nil
+}
+
+// readDepfile records the dependencies listed in the depfile written by
+// body, so that they are part of the node's graph in later builds.
+func (n *Node) readDepfile(body *RuleBody) {
+	var expandErr error
+	name := expandText(body.Depfile, n.lookup, func(err error) {
+		if expandErr == nil {
+			expandErr = err
+		}
+	})
+	if expandErr != nil {
+		log.Printf("Failed to expand depfile %s of %s: %s", body.Depfile, n.Name(), expandErr)
+		return
+	}
+	bs, err := ioutil.ReadFile(n.pathOf(name))
+	if err != nil {
+		log.Printf("Failed to read depfile of %s: %s", n.Name(), err)
+		return
+	}
+	if err := loadState().setDeps(n.key(), parseDepfile(string(bs))); err != nil {
+		log.Printf("Failed to save dependencies of %s: %s", n.Name(), err)
+	}
+}
+
 func (n *Node) BuildDate() time.Time {
 	for _, body := range n.RuleSet.Bodies {
 		if body.RuleType == "build_date" {
-			execBody := strings.Join(body.Lines, "\n")
-			cmd := exec.Command("bash", "-s")
-			var vars []string
-			for _, v := range n.Vars {
-				vars = append(vars, fmt.Sprintf("%s=%s", v.Name, v.Value))
-			}
-			strs := n.RuleSet.Target.Captures(n.Target)
-			for i, s := range strs {
-				vars = append(vars, fmt.Sprintf("match_%d=%s", i, s))
-			}
-			vars = append(vars, fmt.Sprintf("target=%s", n.Target))
-			cmd.Env = append(os.Environ(), vars...)
-			cmd.Stdin = strings.NewReader(addHeader(execBody))
+			var output bytes.Buffer
+			s := n.script(body)
+			s.Stdout = &output
 			if Verbose {
-				cmd.Stderr = os.Stderr
+				s.Stderr = os.Stderr
 			}
-			cmd.ExtraFiles = []*os.File{os.Stderr}
-			output, err := cmd.Output()
+			err := n.executor().Execute(s)
 			if err != nil {
 				//log.Printf("Failed to run build_date target for target %s: %s", n.Target, err)
 				return time.Time{}
 			}
-			t, err := time.Parse(time.RFC1123Z, strings.TrimSpace(string(output)))
+			t, err := time.Parse(time.RFC1123Z, strings.TrimSpace(output.String()))
 			if err != nil {
-				log.Printf("Failed to parse date from build_date target for target %s: %s [Output: %s]", n.Target, err, strings.TrimSpace(string(output)))
+				log.Printf("Failed to parse date from build_date target for target %s: %s [Output: %s]", n.Target, err, strings.TrimSpace(output.String()))
 				return time.Time{}
 			}
 			return t
 		}
 	}
-	stat, err := os.Stat(n.Target)
+	if group := n.RuleSet.Target.Group; group != nil {
+		// A group is as old as its oldest target, and is not built until
+		// all of them are.
+		var oldest time.Time
+		for _, g := range group {
+			stat, err := os.Stat(n.pathOf(g))
+			if err != nil {
+				return time.Time{}
+			}
+			if oldest.IsZero() || stat.ModTime().Before(oldest) {
+				oldest = stat.ModTime()
+			}
+		}
+		return oldest
+	}
+	stat, err := os.Stat(n.path())
 	if err != nil {
 		return time.Time{}
 	}
@@ -306,25 +809,37 @@ func (n *Node) BuildDate() time.Time {
 }
 
 func (n *Node) NeedsBuild() bool {
+	needed, _ := n.needsBuild()
+	return needed
+}
+
+// needsBuild reports whether the node needs to be built, and why.
+func (n *Node) needsBuild() (bool, string) {
 	//log.Printf("CHECKING TARGET [%s:%s]", n.Target, n.RuleType)
+	if n.stale != "" {
+		return true, n.stale
+	}
 	if n.RuleType == "" {
 		//log.Printf("Checking Build Date.")
 		thisDate := n.BuildDate()
 		if thisDate.IsZero() {
 			//log.Printf("DATE IS ZERO")
-			return true
+			return true, "it does not exist or has no build date"
 		}
-		for _, out := range n.Outgoing {
+		for key, out := range n.Outgoing {
+			if n.OrderOnly[key] {
+				continue
+			}
 			upstream := out.BuildDate()
 			if upstream.After(thisDate) {
 				//log.Printf("UPSTREAM [%s:%s] IS AFTER THIS DATE", out.Target, out.RuleType)
-				return true
+				return true, fmt.Sprintf("dependency %s is newer", out.Name())
 			}
 		}
 		//log.Printf("NO UPSTREAM IS AFTER THIS DATE")
-		return false
+		return false, "it is newer than all of its dependencies"
 	}
-	return true
+	return true, fmt.Sprintf("rules of type %s are always run", n.RuleType)
 }
 
 func (n *Node) Fail(err error) {
@@ -344,12 +859,21 @@ func (n *Node) Build() error {
 		return nil
 	default:
 	}
-	if !n.NeedsBuild() {
+	needed, why := n.needsBuild()
+	if Explain {
+		log.Printf("%s: %s", n.Name(), n.explain)
+		if needed {
+			log.Printf("%s: building, since %s", n.Name(), why)
+		} else {
+			log.Printf("%s: not building, since %s", n.Name(), why)
+		}
+	}
+	if !needed {
 		if Verbose {
 			if n.RuleType != "" {
-				log.Printf("%s:%s already built.", n.Target, n.RuleType)
+				log.Printf("%s:%s already built.", n.Name(), n.RuleType)
 			} else {
-				log.Printf("%s already built.", n.Target)
+				log.Printf("%s already built.", n.Name())
 			}
 		}
 		close(n.built)
@@ -357,9 +881,9 @@ func (n *Node) Build() error {
 	}
 	body := n.RuleSet.SelectBody(n.RuleType)
 	if body.RuleType != "" {
-		log.Printf("Building %s:%s", n.Target, body.RuleType)
+		log.Printf("Building %s:%s", n.Name(), body.RuleType)
 	} else {
-		log.Printf("Building %s", n.Target)
+		log.Printf("Building %s", n.Name())
 	}
 	if err := n.run(); err != nil {
 		n.buildErr = err
@@ -367,6 +891,9 @@ func (n *Node) Build() error {
 		close(n.built)
 		return err
 	}
+	if body.Depfile != "" {
+		n.readDepfile(body)
+	}
 	//log.Printf("CLOSING BUILT FOR %s", n.Target)
 	close(n.built)
 	return nil
@@ -445,7 +972,7 @@ func Execute(ns []*Node, njobs int) error {
 					err := out.Wait()
 					//log.Printf("Done Waiting for %s", out.Target)
 					if err != nil {
-						errc <- fmt.Errorf("Cannot build %s. Dependency failed: %s", n.Target, err)
+						errc <- fmt.Errorf("Cannot build %s. Dependency failed: %s", n.Name(), err)
 						n.Fail(err)
 						return
 					}
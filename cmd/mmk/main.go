@@ -57,6 +57,60 @@ func splitTarget(t string) (string, string) {
 	return target, t[i+1:]
 }
 
+// stringList is a flag that may be given several times.
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// splitAssignment splits a command-line argument of the form name=value.
+func splitAssignment(arg string) (string, string, bool) {
+	i := strings.Index(arg, "=")
+	if i <= 0 {
+		return "", "", false
+	}
+	name := arg[:i]
+	for j, c := range name {
+		if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || j > 0 && c >= '0' && c <= '9') {
+			return "", "", false
+		}
+	}
+	return name, arg[i+1:], true
+}
+
+// hasRule reports whether res has a rule for target and ruleType. It
+// exits if the mmkfile of target's subdirectory cannot be read.
+func hasRule(res *mmk.RuleSets, target, ruleType string) bool {
+	rule, err := res.LookupRule(target, ruleType)
+	if err != nil {
+		log.Fatalf("Error: %s", err)
+	}
+	return rule != nil
+}
+
+// hasCheckRule reports whether the mmkfile file has a rule for a target
+// named check. Included files are not remade, and an mmkfile that cannot
+// be read has no rules.
+func hasCheckRule(file string, opts mmk.Options) bool {
+	opts.Vars = make(map[string]string)
+	for _, arg := range flag.Args() {
+		if name, value, ok := splitAssignment(arg); ok {
+			opts.Vars[name] = value
+		}
+	}
+	res, err := mmk.ParseOptions(file, opts)
+	if err != nil {
+		return false
+	}
+	return res.RuleFor("check", "") != nil
+}
+
 func main() {
 	mmkfile := flag.String("f", "mmkfile", "the mmkfile to read and execute")
 	//ruleType := flag.String("t", "", "the rule type to execute")
@@ -64,9 +118,22 @@ func main() {
 	jobs := flag.Int("j", runtime.GOMAXPROCS(-1)+1, "max number of concurrent jobs")
 	verbose := flag.Bool("v", false, "run verbosely")
 	printTargets := flag.Bool("t", false, "print out all targets available")
+	check := flag.Bool("check", false, "check the mmkfile and its includes for errors and exit")
+	var includePath stringList
+	flag.Var(&includePath, "I", "add a directory to search for included files (may be repeated)")
+	recursive := flag.Bool("r", false, "use the mmkfiles of subdirectories for targets inside them")
+	explain := flag.Bool("explain", false, "explain which rule is used for each target, and why it is or is not built")
+	watch := flag.Bool("watch", false, "build the targets, then build them again whenever the files they depend on change")
 	flag.Parse()
+	// "mmk check" is the same as "mmk -check", and flags may follow it,
+	// unless the mmkfile has a rule for check, which is built instead.
+	if flag.Arg(0) == "check" && !hasCheckRule(*mmkfile, mmk.Options{IncludePath: includePath, Recursive: *recursive}) {
+		*check = true
+		flag.CommandLine.Parse(flag.Args()[1:])
+	}
 
 	mmk.Verbose = *verbose
+	mmk.Explain = *explain
 	os.Setenv("mmk_verbose", fmt.Sprintf("%t", mmk.Verbose))
 	log.SetFlags(log.Ltime)
 
@@ -77,7 +144,31 @@ func main() {
 
 	//lex(*mmkfile)
 
-	res, err := mmk.Parse(*mmkfile)
+	// Checking, dumping and listing targets must not run anything, so
+	// included files are not remade.
+	remake := !*check && !*dump && !*printTargets
+	opts := mmk.Options{Vars: make(map[string]string), IncludePath: includePath, Recursive: *recursive, Remake: remake, Jobs: *jobs}
+	var targets []string
+	for _, arg := range flag.Args() {
+		if name, value, ok := splitAssignment(arg); ok {
+			opts.Vars[name] = value
+			continue
+		}
+		targets = append(targets, arg)
+	}
+
+	res, err := mmk.ParseOptions(*mmkfile, opts)
+	if *check {
+		if err == nil && *recursive {
+			err = res.LoadDirs()
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		fmt.Printf("%s: OK\n", *mmkfile)
+		return
+	}
 	if err != nil {
 		log.Fatalf("Error: %s", err)
 	}
@@ -89,38 +180,44 @@ func main() {
 	}
 
 	if *printTargets {
-		for _, rs := range res.RuleSets {
-			for _, b := range rs.Bodies {
-				if b.RuleType != "" {
-					fmt.Printf("%s:%s\n", rs.Target, b.RuleType)
-				} else {
-					fmt.Printf("%s\n", rs.Target)
-				}
-			}
+		for _, t := range res.Targets() {
+			fmt.Println(t)
 		}
 		return
 	}
 
-	targets := flag.Args()
 	if len(targets) == 0 {
 		targets = []string{"main"}
 	}
+	var goals []mmk.Goal
 	for _, target := range targets {
 		target, ruleType := splitTarget(target)
-		if res.RuleFor(target, ruleType) == nil {
+		ruleTypes := strings.Split(ruleType, ",")
+		for _, ruleType := range ruleTypes {
+			if !hasRule(res, target, ruleType) {
+				ruleTypes = nil
+				break
+			}
+		}
+		if ruleTypes == nil {
 			target += ":" + ruleType
 			ruleType = ""
-			if res.RuleFor(target, ruleType) == nil {
+			ruleTypes = []string{""}
+			if !hasRule(res, target, ruleType) {
 				log.Fatalf("Could not find target for %s", target)
 			}
 		}
+		if *watch {
+			goals = append(goals, mmk.Goal{Target: target, RuleTypes: ruleTypes})
+			continue
+		}
 		//log.Printf("Target: [%s], RuleType: [%s]", target, ruleType)
 		if ruleType != "" {
 			log.Printf("Starting %s:%s", target, ruleType)
 		} else {
 			log.Printf("Starting %s", target)
 		}
-		graph, err := mmk.GenerateGraph(res, target, ruleType)
+		graph, err := mmk.GenerateGraphForTypes(res, target, ruleTypes)
 		if err != nil {
 			log.Fatalf("Could not construct dependency graph for %s: %s", target, err)
 		}
@@ -129,6 +226,11 @@ func main() {
 			log.Fatalf("Failed to build target %s: %s", target, err)
 		}
 	}
+	if *watch {
+		if err := mmk.Watch(res, goals, *jobs); err != nil {
+			log.Fatalf("Error: %s", err)
+		}
+	}
 }
 
 func printrec(n *mmk.Node) {
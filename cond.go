@@ -0,0 +1,123 @@
+package mmk
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/alecthomas/participle/v2/lexer"
+)
+
+// A Conditional is an if/elif/else/end block. Only the directives in the
+// first branch whose condition holds are used.
+type Conditional struct {
+	Pos lexer.Position
+
+	If    string       `@If`
+	Then  []*Directive `(Newline | @@)*`
+	Elifs []*ElseIf    `@@*`
+	Else  *ElseBranch  `@@?`
+	End   string       `@End`
+}
+
+type ElseIf struct {
+	Pos lexer.Position
+
+	Elif string       `@Elif`
+	Then []*Directive `(Newline | @@)*`
+}
+
+type ElseBranch struct {
+	Else string       `@Else`
+	Then []*Directive `(Newline | @@)*`
+}
+
+// Branch evaluates the conditions of c and returns the directives of the
+// chosen branch, which is empty if no condition holds and there is no
+// else.
+func (c *Conditional) Branch(vs *Vars) ([]*Directive, error) {
+	ok, err := evalCondition(vs, strings.TrimPrefix(c.If, "if"), c.Pos)
+	if err != nil {
+		return nil, err
+	}
+	if ok {
+		return c.Then, nil
+	}
+	for _, elif := range c.Elifs {
+		ok, err := evalCondition(vs, strings.TrimPrefix(elif.Elif, "elif"), elif.Pos)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return elif.Then, nil
+		}
+	}
+	if c.Else != nil {
+		return c.Else.Then, nil
+	}
+	return nil, nil
+}
+
+// evalCondition evaluates the condition of an if or elif. Conditions take
+// one of the forms:
+//
+//	a == b      a and b are equal after expansion
+//	a != b      a and b differ after expansion
+//	defined x   x is an mmk variable or environment variable
+//	$(command)  command exits successfully
+//	a           a is not empty after expansion
+//
+// Any condition may be negated with a leading !.
+func evalCondition(vs *Vars, cond string, pos lexer.Position) (bool, error) {
+	cond = strings.TrimSpace(stripComment(cond))
+	if strings.HasPrefix(cond, "!") {
+		ok, err := evalCondition(vs, cond[1:], pos)
+		return !ok, err
+	}
+	if cond == "" {
+		return false, &Error{Pos: pos, Msg: "Missing condition"}
+	}
+	if cmd, ok := commandSubst(cond); ok {
+		_, err := shellOutput(vs.ExpandCommand(cmd))
+		return err == nil, nil
+	}
+	if strings.HasPrefix(cond, "defined ") {
+		name := strings.TrimSpace(strings.TrimPrefix(cond, "defined "))
+		if vs.Has(name) {
+			return true, nil
+		}
+		_, ok := os.LookupEnv(name)
+		return ok, nil
+	}
+	for _, op := range []string{"==", "!="} {
+		i := strings.Index(cond, op)
+		if i == -1 {
+			continue
+		}
+		a, b := strings.TrimSpace(cond[:i]), strings.TrimSpace(cond[i+len(op):])
+		if a == "" || b == "" {
+			return false, &Error{Pos: pos, Msg: fmt.Sprintf("Malformed condition: %s", cond)}
+		}
+		equal := condOperand(vs, a) == condOperand(vs, b)
+		return equal == (op == "=="), nil
+	}
+	return condOperand(vs, cond) != "", nil
+}
+
+func condOperand(vs *Vars, s string) string {
+	if len(s) >= 2 && s[0] == '"' && s[len(s)-1] == '"' {
+		s = s[1 : len(s)-1]
+	}
+	return strings.TrimSpace(vs.Expand(s))
+}
+
+// stripComment removes a trailing comment, which must be preceded by
+// whitespace.
+func stripComment(s string) string {
+	for i := 1; i < len(s); i++ {
+		if s[i] == '#' && (s[i-1] == ' ' || s[i-1] == '\t') {
+			return s[:i]
+		}
+	}
+	return s
+}
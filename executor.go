@@ -0,0 +1,106 @@
+package mmk
+
+import (
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// A Script is a rule body ready to be executed, along with the environment
+// it should be executed in.
+type Script struct {
+	// Body is the complete text of the script, including any header mmk
+	// prepends to rule bodies.
+	Body string
+	// Env contains the mmk variables for the script in "name=value" form.
+	// Executors should add them to whatever environment they normally
+	// provide.
+	Env []string
+	// Dir is the directory to run the script in. If empty, the script runs
+	// in the executor's current directory.
+	Dir string
+	// Interpreter is the command line of the program that should run the
+	// script. If empty, the script is a bash script.
+	Interpreter []string
+
+	Stdout io.Writer
+	Stderr io.Writer
+	// Echo receives the output of mmkecho, which rule bodies write to file
+	// descriptor 3.
+	Echo io.Writer
+}
+
+// An Executor runs the scripts for rule bodies. Executors must be safe to
+// call from multiple goroutines, since mmk runs independent targets
+// concurrently.
+type Executor interface {
+	Execute(s *Script) error
+}
+
+// DefaultExecutor is used by RuleSets that do not specify an Executor.
+var DefaultExecutor Executor = LocalExecutor{}
+
+// LocalExecutor runs scripts on the local machine. Bash scripts are fed to
+// bash on standard input. Scripts for other interpreters are written to a
+// temporary file, whose name is passed as the interpreter's last argument.
+type LocalExecutor struct{}
+
+func (LocalExecutor) Execute(s *Script) error {
+	var cmd *exec.Cmd
+	if len(s.Interpreter) == 0 {
+		cmd = exec.Command("bash", "-s")
+		cmd.Stdin = strings.NewReader(s.Body)
+	} else {
+		f, err := ioutil.TempFile("", "mmk-script-")
+		if err != nil {
+			return err
+		}
+		defer os.Remove(f.Name())
+		_, err = f.WriteString(s.Body)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+		args := append(s.Interpreter[1:len(s.Interpreter):len(s.Interpreter)], f.Name())
+		cmd = exec.Command(s.Interpreter[0], args...)
+	}
+	cmd.Env = append(os.Environ(), s.Env...)
+	cmd.Dir = s.Dir
+	cmd.Stdout = s.Stdout
+	cmd.Stderr = s.Stderr
+	return runWithEcho(cmd, s.Echo)
+}
+
+// runWithEcho runs cmd with echo connected to file descriptor 3.
+func runWithEcho(cmd *exec.Cmd, echo io.Writer) error {
+	if f, ok := echo.(*os.File); ok {
+		cmd.ExtraFiles = []*os.File{f}
+		return cmd.Run()
+	}
+	if echo == nil {
+		echo = ioutil.Discard
+	}
+	pr, pw, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer pr.Close()
+	cmd.ExtraFiles = []*os.File{pw}
+	if err := cmd.Start(); err != nil {
+		pw.Close()
+		return err
+	}
+	pw.Close()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		io.Copy(echo, pr)
+	}()
+	err = cmd.Wait()
+	<-done
+	return err
+}
@@ -0,0 +1,349 @@
+package mmk
+
+import (
+	"fmt"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// A builtin is a function that can be called from variable values and
+// dependency lists as ${name arg, arg, ...}. Arguments have already been
+// expanded. Builtins return a list of words.
+type builtin func(args []string) ([]string, error)
+
+var builtins map[string]builtin
+
+func init() {
+	builtins = map[string]builtin{
+		"wildcard":   fnWildcard,
+		"patsubst":   fnPatsubst,
+		"subst":      fnSubst,
+		"replace":    fnReplace,
+		"basename":   fnBasename,
+		"dir":        fnDir,
+		"filter":     fnFilter(true),
+		"filter-out": fnFilter(false),
+		"sort":       fnSort,
+		"uniq":       fnUniq,
+		"join":       fnJoin,
+	}
+}
+
+// expandText expands variable references and builtin function calls in s.
+// Variables are resolved with lookup, which receives the name of the
+// variable. Errors from builtins are passed to onError, and the call
+// expands to nothing.
+func expandText(s string, lookup func(string) string, onError func(error)) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' || i+1 == len(s) {
+			b.WriteByte(s[i])
+			continue
+		}
+		c := s[i+1]
+		switch {
+		case c == '{':
+			end := matchBrace(s, i+1)
+			if end == -1 {
+				// Unterminated. Drop it, as os.Expand does.
+				i = len(s)
+				continue
+			}
+			inner := s[i+2 : end]
+			if name, args, ok := splitCall(inner); ok {
+				b.WriteString(callBuiltin(name, args, lookup, onError))
+			} else {
+				b.WriteString(lookup(inner))
+			}
+			i = end
+		case isNameChar(c):
+			j := i + 1
+			for j < len(s) && isNameChar(s[j]) {
+				j++
+			}
+			b.WriteString(lookup(s[i+1 : j]))
+			i = j - 1
+		case c >= '0' && c <= '9' || strings.IndexByte("*#$@!?-", c) != -1:
+			b.WriteString(lookup(s[i+1 : i+2]))
+			i++
+		default:
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
+
+func isNameChar(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
+
+// matchBrace returns the index of the '}' matching the '{' at s[open], or
+// -1 if there is none.
+func matchBrace(s string, open int) int {
+	depth := 0
+	for i := open; i < len(s); i++ {
+		switch s[i] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				return i
+			}
+		}
+	}
+	return -1
+}
+
+// splitCall splits the inside of ${...} into a builtin name and its raw
+// arguments, if it is a builtin call.
+func splitCall(inner string) (string, []string, bool) {
+	i := strings.IndexAny(inner, " \t")
+	if i == -1 {
+		return "", nil, false
+	}
+	name := inner[:i]
+	if _, ok := builtins[name]; !ok {
+		return "", nil, false
+	}
+	var args []string
+	rest := inner[i+1:]
+	depth, start := 0, 0
+	for j := 0; j < len(rest); j++ {
+		switch rest[j] {
+		case '{':
+			depth++
+		case '}':
+			depth--
+		case ',':
+			if depth == 0 {
+				args = append(args, rest[start:j])
+				start = j + 1
+			}
+		}
+	}
+	args = append(args, rest[start:])
+	return name, args, true
+}
+
+func callBuiltin(name string, rawArgs []string, lookup func(string) string, onError func(error)) string {
+	args := make([]string, len(rawArgs))
+	for i, a := range rawArgs {
+		args[i] = strings.TrimSpace(expandText(a, lookup, onError))
+	}
+	words, err := builtins[name](args)
+	if err != nil {
+		if onError != nil {
+			onError(fmt.Errorf("${%s}: %s", name, err))
+		}
+		return ""
+	}
+	return joinWords(words)
+}
+
+// splitWords splits s into words separated by whitespace. Double-quoted
+// strings are single words, and are returned without their quotes.
+func splitWords(s string) []string {
+	var (
+		words  []string
+		word   strings.Builder
+		inWord bool
+		quoted bool
+	)
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case quoted && c == '\\' && i+1 < len(s) && s[i+1] == '"':
+			word.WriteByte('"')
+			i++
+		case c == '"':
+			quoted = !quoted
+			inWord = true
+		case !quoted && (c == ' ' || c == '\t' || c == '\n' || c == '\r'):
+			if inWord {
+				words = append(words, word.String())
+				word.Reset()
+				inWord = false
+			}
+		default:
+			word.WriteByte(c)
+			inWord = true
+		}
+	}
+	if inWord {
+		words = append(words, word.String())
+	}
+	return words
+}
+
+// joinWords joins words with spaces, quoting any words that contain
+// whitespace or are empty, so that splitWords can recover them.
+func joinWords(words []string) string {
+	quoted := make([]string, len(words))
+	for i, w := range words {
+		if w == "" || strings.ContainsAny(w, " \t\n\r\"") {
+			w = `"` + strings.ReplaceAll(w, `"`, `\"`) + `"`
+		}
+		quoted[i] = w
+	}
+	return strings.Join(quoted, " ")
+}
+
+func checkArgs(args []string, n int) error {
+	if len(args) != n {
+		return fmt.Errorf("expected %d arguments, got %d", n, len(args))
+	}
+	return nil
+}
+
+func fnWildcard(args []string) ([]string, error) {
+	var ret []string
+	for _, a := range args {
+		for _, pattern := range splitWords(a) {
+			matches, err := glob(pattern)
+			if err != nil {
+				return nil, err
+			}
+			ret = append(ret, matches...)
+		}
+	}
+	return ret, nil
+}
+
+// matchPattern matches word against a make-style pattern, in which a
+// single % matches any string. It returns the string matched by %.
+func matchPattern(pattern, word string) (string, bool) {
+	i := strings.IndexByte(pattern, '%')
+	if i == -1 {
+		return "", pattern == word
+	}
+	prefix, suffix := pattern[:i], pattern[i+1:]
+	if len(word) < len(prefix)+len(suffix) || !strings.HasPrefix(word, prefix) || !strings.HasSuffix(word, suffix) {
+		return "", false
+	}
+	return word[len(prefix) : len(word)-len(suffix)], true
+}
+
+func fnPatsubst(args []string) ([]string, error) {
+	if err := checkArgs(args, 3); err != nil {
+		return nil, err
+	}
+	var ret []string
+	for _, w := range splitWords(args[2]) {
+		if stem, ok := matchPattern(args[0], w); ok {
+			w = strings.Replace(args[1], "%", stem, 1)
+		}
+		ret = append(ret, w)
+	}
+	return ret, nil
+}
+
+func fnSubst(args []string) ([]string, error) {
+	if err := checkArgs(args, 3); err != nil {
+		return nil, err
+	}
+	var ret []string
+	for _, w := range splitWords(args[2]) {
+		ret = append(ret, strings.ReplaceAll(w, args[0], args[1]))
+	}
+	return ret, nil
+}
+
+var backref = regexp.MustCompile(`\\([0-9])`)
+
+func fnReplace(args []string) ([]string, error) {
+	if err := checkArgs(args, 3); err != nil {
+		return nil, err
+	}
+	re, err := regexp.Compile(args[0])
+	if err != nil {
+		return nil, err
+	}
+	// Capture groups are referenced as \1, \2, ... since $1 would be
+	// expanded as a variable.
+	repl := backref.ReplaceAllString(strings.ReplaceAll(args[1], "$", "$$"), "$${$1}")
+	var ret []string
+	for _, w := range splitWords(args[2]) {
+		ret = append(ret, re.ReplaceAllString(w, repl))
+	}
+	return ret, nil
+}
+
+func fnBasename(args []string) ([]string, error) {
+	if err := checkArgs(args, 1); err != nil {
+		return nil, err
+	}
+	var ret []string
+	for _, w := range splitWords(args[0]) {
+		ret = append(ret, filepath.Base(w))
+	}
+	return ret, nil
+}
+
+func fnDir(args []string) ([]string, error) {
+	if err := checkArgs(args, 1); err != nil {
+		return nil, err
+	}
+	var ret []string
+	for _, w := range splitWords(args[0]) {
+		ret = append(ret, filepath.Dir(w))
+	}
+	return ret, nil
+}
+
+func fnFilter(keep bool) builtin {
+	return func(args []string) ([]string, error) {
+		if err := checkArgs(args, 2); err != nil {
+			return nil, err
+		}
+		patterns := splitWords(args[0])
+		var ret []string
+		for _, w := range splitWords(args[1]) {
+			matched := false
+			for _, p := range patterns {
+				if _, ok := matchPattern(p, w); ok {
+					matched = true
+					break
+				}
+			}
+			if matched == keep {
+				ret = append(ret, w)
+			}
+		}
+		return ret, nil
+	}
+}
+
+func fnSort(args []string) ([]string, error) {
+	if err := checkArgs(args, 1); err != nil {
+		return nil, err
+	}
+	ret := splitWords(args[0])
+	sort.Strings(ret)
+	return ret, nil
+}
+
+func fnUniq(args []string) ([]string, error) {
+	if err := checkArgs(args, 1); err != nil {
+		return nil, err
+	}
+	var ret []string
+	seen := make(map[string]struct{})
+	for _, w := range splitWords(args[0]) {
+		if _, ok := seen[w]; ok {
+			continue
+		}
+		seen[w] = struct{}{}
+		ret = append(ret, w)
+	}
+	return ret, nil
+}
+
+func fnJoin(args []string) ([]string, error) {
+	if err := checkArgs(args, 2); err != nil {
+		return nil, err
+	}
+	return []string{strings.Join(splitWords(args[1]), args[0])}, nil
+}
@@ -0,0 +1,42 @@
+package mmk
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestSplitWords(t *testing.T) {
+	for _, test := range []struct {
+		s     string
+		words []string
+	}{
+		{"", nil},
+		{"  a b\tc\n", []string{"a", "b", "c"}},
+		{`a "b c" d`, []string{"a", "b c", "d"}},
+		{`""`, []string{""}},
+		{`"say \"hi\""`, []string{`say "hi"`}},
+		{`x"y z"`, []string{"xy z"}},
+	} {
+		if words := splitWords(test.s); !reflect.DeepEqual(words, test.words) {
+			t.Errorf("splitWords(%q) = %q, want %q", test.s, words, test.words)
+		}
+	}
+}
+
+func TestJoinWords(t *testing.T) {
+	for _, words := range [][]string{
+		{"a", "b"},
+		{"a b", "c"},
+		{"", "x"},
+		{`say "hi"`},
+		{"tab\there"},
+	} {
+		s := joinWords(words)
+		if got := splitWords(s); !reflect.DeepEqual(got, words) {
+			t.Errorf("splitWords(joinWords(%q)) = %q via %q", words, got, s)
+		}
+	}
+	if s := joinWords([]string{"a b", "c"}); s != `"a b" c` {
+		t.Errorf("joinWords = %q, want %q", s, `"a b" c`)
+	}
+}
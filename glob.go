@@ -0,0 +1,83 @@
+package mmk
+
+import (
+	"io/fs"
+	"path/filepath"
+	"strings"
+)
+
+// isGlob reports whether s contains glob metacharacters.
+func isGlob(s string) bool {
+	return strings.ContainsAny(s, "*?[")
+}
+
+// glob returns the files matching pattern, which uses the syntax of
+// filepath.Match, extended so that a path element of ** matches any number
+// of directories, including none. The matches are sorted.
+func glob(pattern string) ([]string, error) {
+	if !strings.Contains(pattern, "**") {
+		return filepath.Glob(pattern)
+	}
+	if _, err := filepath.Match(pattern, ""); err != nil {
+		return nil, err
+	}
+	parts := strings.Split(filepath.ToSlash(pattern), "/")
+	// Walk from the longest prefix of the pattern without metacharacters.
+	i := 0
+	for i < len(parts)-1 && !isGlob(parts[i]) {
+		i++
+	}
+	root := strings.Join(parts[:i], "/")
+	if root == "" && strings.HasPrefix(pattern, "/") {
+		root = "/"
+	}
+	walkRoot := root
+	if walkRoot == "" {
+		walkRoot = "."
+	}
+	var matches []string
+	err := filepath.WalkDir(walkRoot, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if path == walkRoot {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		rel := filepath.ToSlash(path)
+		if root == "" {
+			if path == "." {
+				return nil
+			}
+		} else {
+			rel = strings.TrimPrefix(strings.TrimPrefix(rel, strings.TrimSuffix(root, "/")), "/")
+		}
+		if matchParts(parts[i:], strings.Split(rel, "/")) {
+			matches = append(matches, path)
+		}
+		return nil
+	})
+	return matches, err
+}
+
+// matchParts matches the elements of a path against the elements of a
+// pattern, where ** matches zero or more elements.
+func matchParts(pattern, path []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			for j := 0; j <= len(path); j++ {
+				if matchParts(pattern[1:], path[j:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(path) == 0 {
+			return false
+		}
+		if ok, _ := filepath.Match(pattern[0], path[0]); !ok {
+			return false
+		}
+		pattern, path = pattern[1:], path[1:]
+	}
+	return len(path) == 0
+}
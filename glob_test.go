@@ -0,0 +1,30 @@
+package mmk
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMatchParts(t *testing.T) {
+	for _, test := range []struct {
+		pattern, path string
+		match         bool
+	}{
+		{"*.go", "main.go", true},
+		{"*.go", "cmd/main.go", false},
+		{"**/*.go", "main.go", true},
+		{"**/*.go", "cmd/mmk/main.go", true},
+		{"cmd/**", "cmd", true},
+		{"cmd/**", "cmd/mmk/main.go", true},
+		{"cmd/**/main.go", "cmd/main.go", true},
+		{"cmd/**/main.go", "cmd/mmk/x/main.go", true},
+		{"cmd/**/main.go", "src/mmk/main.go", false},
+		{"**/x/*.c", "a/b/x/y.c", true},
+		{"**/x/*.c", "a/b/x/y/z.c", false},
+		{"?.c", "ab.c", false},
+	} {
+		if match := matchParts(strings.Split(test.pattern, "/"), strings.Split(test.path, "/")); match != test.match {
+			t.Errorf("matchParts(%q, %q) = %t, want %t", test.pattern, test.path, match, test.match)
+		}
+	}
+}
@@ -0,0 +1,116 @@
+package mmk
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+
+	"github.com/alecthomas/participle/v2/lexer"
+)
+
+// maxCallDepth limits how deeply macro calls may nest, so that a macro
+// calling itself is reported rather than expanded forever.
+const maxCallDepth = 100
+
+// A Macro is a block of directives with parameters, defined with
+// "macro name params..." and "endmacro", and expanded with
+// "call name args...".
+type Macro struct {
+	Pos    lexer.Position
+	Name   string
+	Params []string
+	Body   string
+}
+
+// A MacroCall records the expansion of a macro call.
+type MacroCall struct {
+	Pos  lexer.Position
+	Name string
+	Args []string
+	Text string
+}
+
+// endmacro matches the line ending a macro definition.
+var endmacro = regexp.MustCompile(`(?m)^endmacro[ \t]*(#.*)?\n?\z`)
+
+// parseMacro parses the text of a macro definition, from "macro" to
+// "endmacro".
+func parseMacro(raw string, pos lexer.Position) (*Macro, error) {
+	if !endmacro.MatchString(raw) {
+		name := strings.Fields(strings.SplitN(raw, "\n", 2)[0])[1]
+		return nil, &Error{Pos: pos, Msg: fmt.Sprintf("Unterminated macro %s: no endmacro", name)}
+	}
+	nl := strings.IndexByte(raw, '\n')
+	header := strings.Fields(stripComment(raw[len("macro"):nl]))
+	if len(header) == 0 {
+		return nil, &Error{Pos: pos, Msg: "Macro has no name"}
+	}
+	m := &Macro{Pos: pos, Name: header[0], Params: header[1:]}
+	seen := make(map[string]struct{})
+	for _, p := range m.Params {
+		if !isVarName(p) {
+			return nil, &Error{Pos: pos, Msg: fmt.Sprintf("Invalid parameter name %s for macro %s", p, m.Name)}
+		}
+		if _, ok := seen[p]; ok {
+			return nil, &Error{Pos: pos, Msg: fmt.Sprintf("Duplicate parameter %s for macro %s", p, m.Name)}
+		}
+		seen[p] = struct{}{}
+	}
+	body := raw[nl+1:]
+	m.Body = body[:strings.LastIndex(body, "endmacro")]
+	return m, nil
+}
+
+// parseCall splits the text of a macro call into the macro's name and its
+// arguments. Arguments are separated by whitespace, and may be quoted.
+func parseCall(raw string) (string, []string) {
+	words := splitWords(stripComment(strings.TrimPrefix(raw, "call")))
+	if len(words) == 0 {
+		return "", nil
+	}
+	return words[0], words[1:]
+}
+
+// Expand returns the macro's body with references to its parameters, $name
+// or ${name}, replaced by args. Other references are left alone, to be
+// expanded as usual.
+func (m *Macro) Expand(args []string) (string, error) {
+	if len(args) != len(m.Params) {
+		return "", fmt.Errorf("Macro %s takes %d arguments, got %d", m.Name, len(m.Params), len(args))
+	}
+	values := make(map[string]string)
+	for i, p := range m.Params {
+		values[p] = args[i]
+	}
+	body := m.Body
+	var b strings.Builder
+	for i := 0; i < len(body); i++ {
+		if body[i] != '$' || i+1 == len(body) {
+			b.WriteByte(body[i])
+			continue
+		}
+		c := body[i+1]
+		switch {
+		case c == '{':
+			if end := strings.IndexByte(body[i:], '}'); end != -1 {
+				if v, ok := values[body[i+2:i+end]]; ok {
+					b.WriteString(v)
+					i += end
+					continue
+				}
+			}
+		case isNameChar(c):
+			j := i + 1
+			for j < len(body) && isNameChar(body[j]) {
+				j++
+			}
+			if v, ok := values[body[i+1:j]]; ok {
+				b.WriteString(v)
+				i = j - 1
+				continue
+			}
+		}
+		b.WriteByte(body[i])
+	}
+	return b.String(), nil
+}
@@ -2,14 +2,19 @@ package mmk
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
-	"os/exec"
+	"path"
+	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
 
 	"github.com/alecthomas/participle/v2"
+	"github.com/alecthomas/participle/v2/lexer"
 	"github.com/alecthomas/participle/v2/lexer/stateful"
 )
 
@@ -18,26 +23,49 @@ var Lex = stateful.Must(stateful.Rules{
 		{"String", `"(\\"|[^"])*"`, nil},
 	},
 	"Any": {
-		{"Any", `[^'\s\\]+`, nil},
+		{"Any", `([^'\s\\]|\\\S)+`, nil},
 		{"continue", `\\.*\n\s*`, nil},
 	},
+	// Root is the start of a line. The lexer cannot look behind it, so
+	// "^" in a pattern matches wherever the lexer is. Keywords are only
+	// recognised here instead, and the first other token of a line moves
+	// to Line, until the line ends.
 	"Root": {
 		{"comment", `#.*`, nil},
-		{"Colon", `:`, nil},
+		{"Colon", `:`, stateful.Push("Line")},
 		{"Var", "var", stateful.Push("Var")},
-		{"Include", `^<.*\n`, nil},
+		{"Include", `<.*\n`, nil},
 		{"Ruletype", "ruletype", nil},
+		{"If", `if[ \t][^\n]*`, nil},
+		{"Elif", `elif[ \t][^\n]*`, nil},
+		{"Else", `else[ \t]*(#.*)?(\n|$)`, nil},
+		{"End", `end[ \t]*(#.*)?(\n|$)`, nil},
+		// A target named macro or call is followed by a colon, not a name.
+		// A macro without endmacro runs to the end of the file, so that
+		// parseMacro can report it.
+		{"Macro", `macro[ \t]+[^\s:](?s:.*?)((?m:^)endmacro[ \t]*(#.*)?(\n|$)|\z)`, nil},
+		{"Call", `call[ \t]+[^\s:][^\n]*`, nil},
+		{"String", `"(\\"|[^"])*"`, stateful.Push("Line")},
+		{"Regex", `'(\\'|[^'])*'`, stateful.Push("Line")},
+		{"Any", `([^'\s\\]|\\\S)+`, stateful.Push("Line")},
+		{"continue", `\\.*\n\s*`, nil},
+		{"CmdLine", `\t.*`, nil},
+		{"Newline", `\n`, nil},
+		{"whitespace", `[\t\f\r ]+`, nil}, // Rules starting with a lower-case letter are elided automatically.
+	},
+	"Line": {
+		{"comment", `#.*`, nil},
+		{"Colon", `:`, nil},
 		stateful.Include("String"),
 		{"Regex", `'(\\'|[^'])*'`, nil},
 		stateful.Include("Any"),
-		{"CmdLine", `^\t.*`, nil},
-		{"Newline", `\n`, nil},
-		{"whitespace", `[\t\f\r ]+`, nil}, // Rules starting with a lower-case letter are elided automatically.
+		{"Newline", `\n`, stateful.Pop()},
+		{"whitespace", `[\t\f\r ]+`, nil},
 	},
 	"Var": {
 		{"Vname", "[a-zA-Z][a-zA-Z0-9_-]*", nil},
 		{"Newline", `\n`, stateful.Pop()},
-		{"Equal", "=", stateful.Push("Val")},
+		{"Equal", "[:+?]?=", stateful.Push("Val")},
 		{"whitespace", `[\t\f\r ]+`, nil},
 	},
 	"Val": {
@@ -52,45 +80,152 @@ var Parser = participle.MustBuild(&File{}, participle.Lexer(Lex))
 
 type File struct {
 	Source     string
-	Vars       []*Var
+	Vars       *Vars
 	RuleTypes  map[string]*RuleType
 	Directives []*Directive `(Newline* @@*)*`
+
+	// opts holds the options the top-level file was read with.
+	opts Options
+	// including lists the files that included this one, outermost first.
+	including []string
+	// namespaces holds the files included with "< file as name", by name.
+	namespaces map[string]*RuleSets
+	// macros holds the macros defined so far, by name.
+	macros map[string]*Macro
+	// calls records the expansion of each macro call.
+	calls *[]*MacroCall
+	// includes records the files included by the top-level file and its
+	// plain includes.
+	includes *[]*includeRef
+	// redefined holds pairs of ruletype definitions with the same name,
+	// the first and the one that replaced it.
+	redefined [][2]*RuleType
+	// read records the files read for the top-level file, including
+	// those of namespaces.
+	read *[]string
 }
 
 type Directive struct {
-	Include  string    `@Include`
-	Rule     *Rule     `| @@`
-	Var      *Var      `| Var @@`
-	RuleType *RuleType `| Ruletype @@`
+	Pos lexer.Position
+
+	Include  string       `@Include`
+	Macro    string       `| @Macro`
+	Call     string       `| @Call`
+	If       *Conditional `| @@`
+	Rule     *Rule        `| @@`
+	Var      *Var         `| Var @@`
+	RuleType *RuleType    `| Ruletype @@`
+
+	// optional is set for includes written "<?", which are skipped if the
+	// file does not exist.
+	optional bool
+	// namespace is the name given to a file included with
+	// "< file as name".
+	namespace string
 }
 
 type RuleType struct {
+	Pos lexer.Position
+
 	RuleType     *Elem          `@@`
+	Extends      []*Elem        `("extends" @@+)?`
 	RuleSections []*RuleSection `(Newline? @@)*`
 }
 
 type Var struct {
+	Pos lexer.Position
+
 	Name  string   `@Vname`
-	Value []string `Equal @(Any | String | Vname)*`
+	Op    string   `@Equal`
+	Value []string `@(Any | String | Vname)*`
+
+	appended   []*Var
+	override   bool
+	fromEnv    bool
+	extends    bool
+	immediate  bool
+	evaluating bool
+	evaluated  bool
+	value      string
 }
 
 type Rule struct {
+	Pos lexer.Position
+
 	Target       []*Elem        `@@*`
 	RuleSections []*RuleSection `@@*`
 }
 
 type RuleSection struct {
+	Pos lexer.Position
+
 	SecondPart []Elem   `Colon @@*`
 	Colon      string   `@Colon?`
 	ThirdPart  []Elem   `@@* Newline`
 	Lines      []string `(@CmdLine Newline?)*`
 }
 
+// assignment returns the variable assigned by s, if s is a variable
+// assignment rather than a rule section. An assignment takes the form
+// ": [inherit] name op value...", where op is one of "=", ":=", "+=" or
+// "?=".
+// inherit reports whether the inherit keyword was given.
+func (s *RuleSection) assignment() (v *Var, inherit bool) {
+	words := make([]string, 0, len(s.SecondPart)+len(s.ThirdPart)+1)
+	for i := range s.SecondPart {
+		if s.SecondPart[i].Regex != "" {
+			return nil, false
+		}
+		words = append(words, s.SecondPart[i].Any)
+	}
+	if s.Colon != "" {
+		// "name := value" is lexed as "name" ":" "= value".
+		if len(s.ThirdPart) == 0 || s.ThirdPart[0].Any != "=" {
+			return nil, false
+		}
+		words = append(words, ":=")
+		for i := range s.ThirdPart[1:] {
+			words = append(words, s.ThirdPart[i+1].Raw())
+		}
+	}
+	if len(words) > 2 && words[0] == "inherit" && isAssignOp(words[2]) {
+		inherit = true
+		words = words[1:]
+	}
+	if len(words) < 2 || !isAssignOp(words[1]) || !isVarName(words[0]) {
+		return nil, false
+	}
+	return &Var{Pos: s.Pos, Name: words[0], Op: words[1], Value: words[2:]}, inherit
+}
+
+func isAssignment(s *RuleSection) bool {
+	v, _ := s.assignment()
+	return v != nil
+}
+
+func isAssignOp(s string) bool {
+	return s == "=" || s == ":=" || s == "+=" || s == "?="
+}
+
+func isVarName(s string) bool {
+	if s == "" || s[0] >= '0' && s[0] <= '9' {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !isNameChar(s[i]) {
+			return false
+		}
+	}
+	return true
+}
+
 type Elems struct {
 	Elems []Elem `@@`
 }
 
 type Elem struct {
+	Pos lexer.Position
+
 	Any string `@(Any | String)`
 	//String string `| @String`
 	Regex string `| @Regex`
@@ -126,34 +261,50 @@ func (e *Elem) Combine(e2 *Elem) *Elem {
 		s2 = strings.Trim(e2.Any, `"`)
 	}
 
-	fmt.Printf(" COMBINING [%s] with [%s]\n", s1, s2)
 	if isRegex {
-		return &Elem{Regex: s1 + s2}
+		return &Elem{Pos: e.Pos, Regex: "'" + s1 + s2 + "'"}
 	} else {
-		return &Elem{Any: s1 + s2}
+		return &Elem{Pos: e.Pos, Any: s1 + s2}
 	}
 }
 
-func (e *Elem) Expand(m map[string]string) {
+func (e *Elem) Expand(lookup func(string) string) {
 	if e.Any != "" {
-		e.Any = os.Expand(e.Any, func(s string) string {
-			return m[s]
-		})
+		e.Any = os.Expand(e.Any, lookup)
 	}
 }
 
-func (e *Elem) Value() *Matcher {
+// Value returns a Matcher for the element. It returns an error if the
+// element is a regular expression that does not compile.
+func (e *Elem) Value() (*Matcher, error) {
 	if e.Any != "" {
-		return &Matcher{Str: strings.Trim(e.Any, `"`)}
-	} else {
-		return &Matcher{Regex: regexp.MustCompile("^" + strings.Trim(e.Regex, `'`) + "$")}
+		return &Matcher{Str: strings.Trim(e.Any, `"`)}, nil
 	}
+	re, err := regexp.Compile("^" + strings.Trim(e.Regex, `'`) + "$")
+	if err != nil {
+		return nil, &Error{Pos: e.Pos, Msg: fmt.Sprintf("Invalid regular expression %s: %s", e.Regex, err)}
+	}
+	return &Matcher{Regex: re}, nil
 }
 
-func combineExpandElems(es []*Elem, m map[string]string) *Elem {
+// elemStrings returns the string form of each element, as used for rule
+// types and flags.
+func elemStrings(es []Elem) ([]string, error) {
+	var ret []string
+	for i := range es {
+		m, err := es[i].Value()
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, m.String())
+	}
+	return ret, nil
+}
+
+func combineExpandElems(es []*Elem, lookup func(string) string) *Elem {
 	var ret *Elem
 	for i, e := range es {
-		e.Expand(m)
+		e.Expand(lookup)
 		if i == 0 {
 			ret = e
 		} else {
@@ -166,10 +317,13 @@ func combineExpandElems(es []*Elem, m map[string]string) *Elem {
 type Matcher struct {
 	Str   string
 	Regex *regexp.Regexp
+	// Group holds the targets of a grouped rule, "a & b : ...", all of
+	// which are made by a single run of the rule.
+	Group []string
 }
 
 func (m *Matcher) Captures(s string) []string {
-	if m.Str != "" {
+	if m.Regex == nil {
 		return nil
 	}
 	return m.Regex.FindStringSubmatch(s)
@@ -178,6 +332,14 @@ func (m *Matcher) Captures(s string) []string {
 func (m *Matcher) Matches(s string) bool {
 	//log.Printf("Checking (%s)%#v matches %s", m, m, s)
 	//defer func() { log.Printf("Returning %t", ret) }()
+	if m.Group != nil {
+		for _, g := range m.Group {
+			if g == s {
+				return true
+			}
+		}
+		return false
+	}
 	if m.Str != "" {
 		return m.Str == s
 	}
@@ -185,20 +347,270 @@ func (m *Matcher) Matches(s string) bool {
 }
 
 func (m *Matcher) String() string {
+	if m.Group != nil {
+		return strings.Join(m.Group, " "+groupSep+" ")
+	}
 	if m.Str != "" {
 		return m.Str
 	}
 	return m.Regex.String()
 }
 
+// names returns the names m matches, or its regular expression.
+func (m *Matcher) names() []string {
+	if m.Group != nil {
+		return m.Group
+	}
+	return []string{m.String()}
+}
+
+// groupSep separates the targets of a grouped rule.
+const groupSep = "&"
+
+// ruleTarget returns a Matcher for the target of a rule, whose elements
+// are expanded with lookup. Targets separated by groupSep make a group,
+// and must not be regular expressions.
+func ruleTarget(es []*Elem, lookup func(string) string) (*Matcher, error) {
+	var parts [][]*Elem
+	start := 0
+	for i, e := range es {
+		if e.Raw() == groupSep {
+			parts = append(parts, es[start:i])
+			start = i + 1
+		}
+	}
+	if len(parts) == 0 {
+		return combineExpandElems(es, lookup).Value()
+	}
+	parts = append(parts, es[start:])
+	m := &Matcher{}
+	seen := make(map[string]struct{})
+	for _, part := range parts {
+		if len(part) == 0 {
+			return nil, &Error{Pos: es[0].Pos, Msg: "Grouped target is missing a target"}
+		}
+		e := combineExpandElems(part, lookup)
+		pm, err := e.Value()
+		if err != nil {
+			return nil, err
+		}
+		if pm.Str == "" {
+			return nil, &Error{Pos: e.Pos, Msg: fmt.Sprintf("Grouped target %s cannot be a regular expression", e.Regex)}
+		}
+		if _, ok := seen[pm.Str]; ok {
+			return nil, &Error{Pos: e.Pos, Msg: fmt.Sprintf("Target %s appears twice in group", pm.Str)}
+		}
+		seen[pm.Str] = struct{}{}
+		m.Group = append(m.Group, pm.Str)
+	}
+	return m, nil
+}
+
 type RuleSets struct {
-	Vars     []*Var
+	Vars     *Vars
 	RuleSets []*RuleSet
+	// TargetVars holds the target-specific variables, in the order they
+	// were defined.
+	TargetVars []*TargetVar
+	// Calls records the macro calls that were expanded, in order.
+	Calls []*MacroCall
+	// Default is the .DEFAULT rule, or nil if there is none.
+	Default *RuleSet
+	// Executor runs the rule bodies. If nil, the enclosing RuleSets'
+	// Executor is used, or DefaultExecutor at the top level.
+	Executor Executor
+	// Namespaces holds the mmkfiles included with "< file as name", by
+	// name. Their targets are named "name/target".
+	Namespaces map[string]*RuleSets
+	// Prefix is prepended to the names of targets in a namespace, and is
+	// empty at the top level.
+	Prefix string
+	// Dir is the directory that a namespace's rule bodies run in, and that
+	// its file names are relative to. It is empty at the top level.
+	Dir    string
+	parent *RuleSets
+	opts   Options
+	// dirs holds the directories checked for mmkfiles when reading
+	// recursively, and the errors reading them.
+	dirs map[string]error
+	// sources lists the mmkfile and the files it includes.
+	sources []string
+	// read records the files read for the top-level file, including
+	// namespaces and the mmkfiles of subdirectories.
+	read *[]string
+}
+
+// setPrefix sets the prefix of r and of the namespaces inside it.
+func (r *RuleSets) setPrefix(prefix string) {
+	r.Prefix = prefix
+	for name, ns := range r.Namespaces {
+		ns.setPrefix(prefix + name + "/")
+	}
+}
+
+// namespaceFor returns the RuleSets that target belongs to, which may be
+// a namespace inside r, and target's name within it.
+func (r *RuleSets) namespaceFor(target string) (*RuleSets, string, error) {
+	for {
+		ns, local, err := r.childNamespace(target)
+		if err != nil {
+			return nil, "", err
+		}
+		if ns == nil {
+			return r, target, nil
+		}
+		r, target = ns, local
+	}
+}
+
+// childNamespace returns the namespace directly inside r that target
+// belongs to, and target's name within it. It returns nil if target is not
+// in a namespace, and an error if the mmkfile of target's directory
+// cannot be read.
+func (r *RuleSets) childNamespace(target string) (*RuleSets, string, error) {
+	for i := 0; i < len(target); i++ {
+		if target[i] != '/' {
+			continue
+		}
+		name := target[:i]
+		if ns, ok := r.Namespaces[name]; ok {
+			return ns, target[i+1:], nil
+		}
+		ns, err := r.loadDir(name)
+		if err != nil {
+			return nil, "", err
+		}
+		if ns != nil {
+			return ns, target[i+1:], nil
+		}
+	}
+	return nil, "", nil
+}
+
+// loadDir reads the mmkfile in the directory dir as a namespace named dir,
+// when reading recursively. It returns nil if there is no such mmkfile,
+// and an error if it cannot be read. Each directory is only checked once.
+func (r *RuleSets) loadDir(dir string) (*RuleSets, error) {
+	if !r.opts.Recursive {
+		return nil, nil
+	}
+	for _, part := range strings.Split(dir, "/") {
+		if part == "" || part == "." || part == ".." {
+			return nil, nil
+		}
+	}
+	if r.dirs == nil {
+		r.dirs = make(map[string]error)
+	}
+	if err, ok := r.dirs[dir]; ok {
+		return nil, err
+	}
+	r.dirs[dir] = nil
+	file := filepath.Join(r.path(dir), "mmkfile")
+	if !fileExists(file) {
+		return nil, nil
+	}
+	r.addRead(file)
+	f, err := parseFile(file)
+	if err != nil {
+		r.dirs[dir] = err
+		return nil, err
+	}
+	f.opts = r.opts
+	f.read = r.read
+	ns, err := convertNamespace(f)
+	if err != nil {
+		r.dirs[dir] = err
+		return nil, err
+	}
+	ns.parent = r
+	ns.setPrefix(r.Prefix + dir + "/")
+	r.Namespaces[dir] = ns
+	return ns, nil
+}
+
+// LoadDirs reads the mmkfiles of every subdirectory, as reading
+// recursively does when their targets are needed, and returns the errors
+// found in them. Directories whose names start with '.' are skipped.
+func (r *RuleSets) LoadDirs() error {
+	var msgs []string
+	var walk func(r *RuleSets, dir string)
+	walk = func(r *RuleSets, dir string) {
+		name := r.path(dir)
+		if name == "" {
+			name = "."
+		}
+		entries, err := ioutil.ReadDir(name)
+		if err != nil {
+			msgs = append(msgs, err.Error())
+			return
+		}
+		for _, e := range entries {
+			if !e.IsDir() || strings.HasPrefix(e.Name(), ".") {
+				continue
+			}
+			sub := path.Join(dir, e.Name())
+			if ns, ok := r.Namespaces[sub]; ok {
+				walk(ns, "")
+				continue
+			}
+			ns, err := r.loadDir(sub)
+			if err != nil {
+				msgs = append(msgs, err.Error())
+				continue
+			}
+			if ns != nil {
+				walk(ns, "")
+			} else {
+				walk(r, sub)
+			}
+		}
+	}
+	walk(r, "")
+	if len(msgs) > 0 {
+		return errors.New(strings.Join(msgs, "\n"))
+	}
+	return nil
+}
+
+// path returns the path of the file named target in r.
+func (r *RuleSets) path(target string) string {
+	if r.Dir == "" || filepath.IsAbs(target) {
+		return target
+	}
+	return filepath.Join(r.Dir, target)
+}
+
+func (r *RuleSets) executor() Executor {
+	for ; r != nil; r = r.parent {
+		if r.Executor != nil {
+			return r.Executor
+		}
+	}
+	return nil
 }
 
 type RuleSet struct {
+	Pos    lexer.Position
 	Target *Matcher
 	Bodies []*RuleBody
+	// Vars holds the variables assigned in a ruletype. The rule of a
+	// target has none, since they belong to the bodies of the ruletype.
+	Vars []*Var
+}
+
+// defaultTarget is the target of the rule used for targets that have no
+// other rule and do not exist.
+const defaultTarget = ".DEFAULT"
+
+// A TargetVar is a variable that is defined only for targets matching
+// Target.
+type TargetVar struct {
+	Target *Matcher
+	Var    *Var
+	// Inherit is set if the variable is also defined for the target's
+	// dependencies.
+	Inherit bool
 }
 
 type RuleBody struct {
@@ -206,9 +618,134 @@ type RuleBody struct {
 	FailOK       bool
 	Dependencies []string
 	Lines        []string
+	// Interpreter is the command line used to run Lines. It is empty for
+	// bash, which is the default.
+	Interpreter []string
+	// Aliases are other names the body can be selected by.
+	Aliases []string
+	// Fallback is set for bodies that are only used for targets that
+	// no other rule matches, and that do not exist.
+	Fallback bool
+	// Depfile names the Makefile-format file, listing the target's
+	// dependencies, that the body writes. It is expanded like a
+	// dependency.
+	Depfile string
+	// Vars holds the variables assigned in the ruletype the body comes
+	// from. They only apply to targets built with the body.
+	Vars []*Var
+	// origin is the name of the ruletype that defines the body, if any.
+	origin string
+}
+
+// ruleFlags lists the flags that may follow a rule type. Flags ending in
+// '=' take a value.
+var ruleFlags = []string{"failok", "interpreter=", "alias=", "fallback", "depfile="}
+
+func isRuleFlag(t string) bool {
+	for _, f := range ruleFlags {
+		if t == f || strings.HasSuffix(f, "=") && strings.HasPrefix(t, f) {
+			return true
+		}
+	}
+	return false
 }
 
+// setType sets the rule type and applies the flags given in ruleTypes,
+// which holds the words of a rule section's type.
+func (rb *RuleBody) setType(ruleTypes []string) {
+	for i, t := range ruleTypes {
+		if i == 0 && !isRuleFlag(t) {
+			rb.RuleType = t
+		}
+		if t == "failok" {
+			rb.FailOK = true
+		}
+		if t == "fallback" {
+			rb.Fallback = true
+		}
+		if strings.HasPrefix(t, "interpreter=") {
+			rb.Interpreter = []string{strings.TrimPrefix(t, "interpreter=")}
+		}
+		if strings.HasPrefix(t, "alias=") {
+			rb.Aliases = append(rb.Aliases, strings.TrimPrefix(t, "alias="))
+		}
+		if strings.HasPrefix(t, "depfile=") {
+			rb.Depfile = strings.TrimPrefix(t, "depfile=")
+		}
+	}
+}
+
+// setLines sets the body's lines. If the first line is a shebang (#!), it
+// is removed and used as the body's interpreter.
+func (rb *RuleBody) setLines(lines []string) {
+	if len(lines) > 0 && strings.HasPrefix(lines[0], "#!") {
+		rb.Interpreter = strings.Fields(lines[0][2:])
+		lines = lines[1:]
+	}
+	if isBash(rb.Interpreter) {
+		rb.Interpreter = nil
+	}
+	if len(rb.Interpreter) > 0 {
+		lines = dedent(lines)
+	}
+	rb.Lines = lines
+}
+
+// dedent removes the indentation common to all non-blank lines.
+func dedent(lines []string) []string {
+	prefix := ""
+	first := true
+	for _, l := range lines {
+		if strings.TrimSpace(l) == "" {
+			continue
+		}
+		indent := l[:len(l)-len(strings.TrimLeft(l, " \t"))]
+		if first {
+			prefix = indent
+			first = false
+			continue
+		}
+		for !strings.HasPrefix(indent, prefix) {
+			prefix = prefix[:len(prefix)-1]
+		}
+	}
+	if prefix == "" {
+		return lines
+	}
+	ret := make([]string, len(lines))
+	for i, l := range lines {
+		ret[i] = strings.TrimPrefix(l, prefix)
+	}
+	return ret
+}
+
+// isBash reports whether the interpreter command line runs bash.
+func isBash(interpreter []string) bool {
+	if len(interpreter) == 0 {
+		return false
+	}
+	cmd := filepath.Base(interpreter[0])
+	if cmd == "env" && len(interpreter) > 1 {
+		cmd = filepath.Base(interpreter[1])
+	}
+	return cmd == "bash"
+}
+
+// SelectBody returns the body to use for ruleType, or nil if there is
+// none. ruleType may be a rule type, an alias given to a body with the
+// alias= flag, or a list of these separated by '|', which are tried in
+// order. The empty rule type selects the first body.
 func (r *RuleSet) SelectBody(ruleType string) *RuleBody {
+	for _, alt := range strings.Split(ruleType, "|") {
+		if body := r.bodyFor(alt); body != nil {
+			return body
+		}
+	}
+	return nil
+}
+
+// bodyFor returns the body for a single rule type or alias.
+func (r *RuleSet) bodyFor(ruleType string) *RuleBody {
 	if ruleType == "" {
 		if len(r.Bodies) > 0 {
 			return r.Bodies[0]
@@ -216,43 +753,148 @@ func (r *RuleSet) SelectBody(ruleType string) *RuleBody {
 		return nil
 	}
 	for _, body := range r.Bodies {
-		// TODO: Allow other ruleType selection methods
 		if body.RuleType == ruleType {
 			return body
 		}
 	}
+	for _, body := range r.Bodies {
+		for _, alias := range body.Aliases {
+			if alias == ruleType {
+				return body
+			}
+		}
+	}
 	return nil
 }
 
+// selectedType returns the rule type of the node that builds ruleType with
+// body. Aliases are replaced by the rule type they stand for, so that each
+// body has one node.
+func selectedType(ruleType string, body *RuleBody) string {
+	if ruleType == "" {
+		return ""
+	}
+	return body.RuleType
+}
+
 func (r *RuleSets) Print() {
 	fmt.Printf("[Vars: \n")
-	for _, v := range r.Vars {
-		fmt.Printf("\t%s=%#v\n", v.Name, v.Value)
+	for _, v := range r.Vars.List() {
+		fmt.Printf("\t%s %s %#v\n", v.Name, v.Op, v.Value)
+		for _, a := range v.appended {
+			fmt.Printf("\t%s %s %#v\n", a.Name, a.Op, a.Value)
+		}
 	}
 	fmt.Printf("]\n")
+	for _, c := range r.Calls {
+		fmt.Printf("[Call: %s %s] [At: %s]\n", c.Name, joinWords(c.Args), c.Pos)
+		for _, line := range strings.Split(strings.TrimRight(c.Text, "\n"), "\n") {
+			fmt.Printf("\t%s\n", line)
+		}
+	}
+	for _, tv := range r.TargetVars {
+		inherit := ""
+		if tv.Inherit {
+			inherit = "inherit "
+		}
+		fmt.Printf("[Target: %s] %s%s %s %#v\n", tv.Target, inherit, tv.Var.Name, tv.Var.Op, tv.Var.Value)
+	}
 	for _, rs := range r.RuleSets {
 		fmt.Printf("[Target: %s]\n", rs.Target)
 		for _, body := range rs.Bodies {
 			fmt.Printf("\t [Type: %s] -> [Deps: %s]:\n", body.RuleType, strings.Join(body.Dependencies, ", "))
+			for _, v := range body.Vars {
+				fmt.Printf("\t\t%s %s %#v\n", v.Name, v.Op, v.Value)
+			}
 			for _, line := range body.Lines {
 				fmt.Printf("\t\t%s\n", line)
 			}
 		}
 	}
+	for _, name := range r.namespaceNames() {
+		ns := r.Namespaces[name]
+		fmt.Printf("[Namespace: %s] [Dir: %s]\n", strings.TrimSuffix(ns.Prefix, "/"), ns.Dir)
+		ns.Print()
+	}
+}
+
+func (r *RuleSets) namespaceNames() []string {
+	var names []string
+	for name := range r.Namespaces {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Targets returns the names of the targets defined in r and its
+// namespaces, in "target" or "target:ruletype" form.
+func (r *RuleSets) Targets() []string {
+	var ret []string
+	for _, rs := range r.RuleSets {
+		for _, name := range rs.Target.names() {
+			for _, b := range rs.Bodies {
+				if b.RuleType != "" {
+					ret = append(ret, fmt.Sprintf("%s%s:%s", r.Prefix, name, b.RuleType))
+				} else {
+					ret = append(ret, fmt.Sprintf("%s%s", r.Prefix, name))
+				}
+			}
+		}
+	}
+	for _, name := range r.namespaceNames() {
+		ret = append(ret, r.Namespaces[name].Targets()...)
+	}
+	return ret
 }
 
+// RuleFor returns the rule for target and ruleType, including fallback
+// rules, or nil if there is none. It also returns nil if target is in a
+// subdirectory whose mmkfile cannot be read, which LookupRule reports.
 func (r *RuleSets) RuleFor(target, ruleType string) *RuleSet {
-	for _, s := range r.RuleSets {
-		//log.Printf("Finding %s:%s Checking for target %s", target, ruleType, s.Target.String())
-		//log.Printf("TARGET MATCHES: %t, BODY(%s): %p", s.Target.Matches(target), ruleType, s.SelectBody(ruleType))
-		if s.Target.Matches(target) && s.SelectBody(ruleType) != nil {
-			//log.Printf("RETURNING %p", s)
-			return s
-		} else {
-			//log.Printf("RETURNING NIL!")
+	s, _ := r.LookupRule(target, ruleType)
+	return s
+}
+
+// LookupRule is like RuleFor, but returns an error if target is in a
+// subdirectory whose mmkfile cannot be read.
+func (r *RuleSets) LookupRule(target, ruleType string) (*RuleSet, error) {
+	ns, local, err := r.namespaceFor(target)
+	if err != nil {
+		return nil, err
+	}
+	if ns != r {
+		return ns.LookupRule(local, ruleType)
+	}
+	s, _ := r.ruleFor(target, ruleType, false)
+	if s == nil {
+		s, _ = r.ruleFor(target, ruleType, true)
+	}
+	return s, nil
+}
+
+// ruleFor returns the rule for target and ruleType, and the rule type of
+// the node that builds it. Each alternative in ruleType is tried against
+// every rule before the next alternative is. If fallback is set, only
+// fallback bodies and the .DEFAULT rule are considered, and otherwise they
+// are ignored.
+func (r *RuleSets) ruleFor(target, ruleType string, fallback bool) (*RuleSet, string) {
+	sets := r.RuleSets
+	if fallback && r.Default != nil {
+		sets = append(sets[:len(sets):len(sets)], r.Default)
+	}
+	for _, alt := range strings.Split(ruleType, "|") {
+		for _, s := range sets {
+			//log.Printf("Finding %s:%s Checking for target %s", target, ruleType, s.Target.String())
+			if s != r.Default && !s.Target.Matches(target) {
+				continue
+			}
+			if body := s.bodyFor(alt); body != nil && body.Fallback == fallback {
+				return s, selectedType(alt, body)
+			}
 		}
 	}
-	return nil
+	return nil, ""
 }
 
 func parseFile(file string) (*File, error) {
@@ -268,82 +910,286 @@ func parseFile(file string) (*File, error) {
 		return nil, err
 	}
 	ret.Source = file
+	ret.Vars = NewVars()
+	ret.namespaces = make(map[string]*RuleSets)
+	ret.macros = make(map[string]*Macro)
+	ret.calls = new([]*MacroCall)
 	sanitize(ret)
 	return ret, nil
 }
 
-func expand(f *File) error {
-	var newDirectives []*Directive
-	ruleTypes := make(map[string]*RuleType)
-	for _, directive := range f.Directives {
-		if directive.Include != "" {
-			incf, err := parseFile(directive.Include)
-			if err != nil {
-				return fmt.Errorf("In File %s: <%s: %s", f.Source, directive.Include, err)
-			}
-			err = expand(incf)
+// resolveInclude returns the files named by an include of name in f.
+// Relative names are resolved against the directory containing f, and
+// then against each directory in the include path. Names may be glob
+// patterns, in which case every matching file is returned. It returns no
+// files if name cannot be found.
+func (f *File) resolveInclude(name string) ([]string, error) {
+	candidates := []string{name}
+	if !filepath.IsAbs(name) {
+		candidates = []string{filepath.Join(filepath.Dir(f.Source), name)}
+		for _, dir := range f.opts.IncludePath {
+			candidates = append(candidates, filepath.Join(dir, name))
+		}
+	}
+	for _, c := range candidates {
+		if isGlob(c) {
+			matches, err := glob(c)
 			if err != nil {
-				return err
+				return nil, err
 			}
-			newDirectives = append(newDirectives, incf.Directives...)
-			for k, rt := range incf.RuleTypes {
-				ruleTypes[k] = rt
+			if len(matches) > 0 {
+				return matches, nil
 			}
-			f.Vars = append(f.Vars, incf.Vars...)
-		} else if directive.Var != nil {
-			joined := strings.Join(directive.Var.Value, " ")
-			//joined := directive.Var.Value
-			if strings.HasPrefix(joined, "$(") && strings.HasSuffix(joined, ")") {
-				cmdBody := joined[2:]
-				cmdBody = cmdBody[:len(cmdBody)-1]
-				//log.Printf("CMD: %s\n", cmdBody)
-				cmd := exec.Command("bash", "-c", cmdBody)
-				//cmd.Stdin = strings.NewReader(addHeader(execBody, n.Target, n.Vars))
-				cmd.Stderr = os.Stderr
-				output, err := cmd.Output()
+		} else if fileExists(c) {
+			return []string{c}, nil
+		}
+	}
+	return nil, nil
+}
+
+// include parses file, which was included by directive.
+func (f *File) include(directive *Directive, file string) (*File, error) {
+	fail := func(msg string) error {
+		return &Error{Pos: directive.Pos, Msg: fmt.Sprintf("<%s: %s", directive.Include, msg)}
+	}
+	chain := append(f.including[:len(f.including):len(f.including)], f.Source)
+	abs, err := filepath.Abs(file)
+	if err != nil {
+		return nil, fail(err.Error())
+	}
+	for i, inc := range chain {
+		if incAbs, err := filepath.Abs(inc); err == nil && incAbs == abs {
+			return nil, fail(fmt.Sprintf("Include cycle: %s -> %s", strings.Join(chain[i:], " -> "), file))
+		}
+	}
+	if f.read != nil {
+		*f.read = append(*f.read, file)
+	}
+	incf, err := parseFile(file)
+	if err != nil {
+		return nil, fail(err.Error())
+	}
+	incf.opts = f.opts
+	incf.including = chain
+	incf.read = f.read
+	return incf, nil
+}
+
+// includeNamespace reads file, which was included by directive, as the
+// namespace directive.namespace. The file has its own variables, apart
+// from those set on the command line.
+func (f *File) includeNamespace(directive *Directive, file string) error {
+	if _, ok := f.namespaces[directive.namespace]; ok {
+		return &Error{Pos: directive.Pos, Msg: fmt.Sprintf("Duplicate namespace %s", directive.namespace)}
+	}
+	incf, err := f.include(directive, file)
+	if err != nil {
+		return err
+	}
+	rs, err := convertNamespace(incf)
+	if err != nil {
+		return err
+	}
+	rs.setPrefix(directive.namespace + "/")
+	f.namespaces[directive.namespace] = rs
+	return nil
+}
+
+// convertNamespace converts f, which is to be used as a namespace. Its
+// rules run in the directory containing it.
+func convertNamespace(f *File) (*RuleSets, error) {
+	for name, value := range f.opts.Vars {
+		f.Vars.Override(name, value)
+	}
+	rs, err := convert(f)
+	if err != nil {
+		return nil, err
+	}
+	rs.Dir = filepath.Dir(f.Source)
+	return rs, nil
+}
+
+func expand(f *File) error {
+	var newDirectives []*Directive
+	ruleTypes := make(map[string]*RuleType)
+	addRuleType := func(name string, rt *RuleType) {
+		// The same file may be included more than once.
+		if first, ok := ruleTypes[name]; ok && first.Pos != rt.Pos {
+			f.redefined = append(f.redefined, [2]*RuleType{first, rt})
+		}
+		ruleTypes[name] = rt
+	}
+	// depth counts the macro calls being expanded, and outerCall is the
+	// position of the outermost one.
+	depth := 0
+	var outerCall lexer.Position
+	var expandDirectives func([]*Directive) error
+	expandDirectives = func(directives []*Directive) error {
+		for _, directive := range directives {
+			if directive.Macro != "" {
+				m, err := parseMacro(directive.Macro, directive.Pos)
 				if err != nil {
-					log.Printf("%s Error: %s", cmdBody, err)
-					directive.Var.Value = []string{""}
-					//directive.Var.Value = ""
-				} else {
-					directive.Var.Value = []string{strings.TrimSpace(string(output))}
-					//directive.Var.Value = strings.TrimSpace(string(output))
+					return err
 				}
+				f.macros[m.Name] = m
+			} else if directive.Call != "" {
+				name, args := parseCall(directive.Call)
+				m, ok := f.macros[name]
+				if !ok {
+					return &Error{Pos: directive.Pos, Msg: fmt.Sprintf("Undefined macro %s", name)}
+				}
+				if depth == 0 {
+					outerCall = directive.Pos
+				}
+				if depth == maxCallDepth {
+					return &Error{Pos: outerCall, Msg: fmt.Sprintf("Macro calls nested more than %d deep, calling %s", maxCallDepth, name)}
+				}
+				text, err := m.Expand(args)
+				if err != nil {
+					return &Error{Pos: directive.Pos, Msg: err.Error()}
+				}
+				*f.calls = append(*f.calls, &MacroCall{Pos: directive.Pos, Name: name, Args: args, Text: text})
+				callf := &File{}
+				source := fmt.Sprintf("%s:%d(%s)", directive.Pos.Filename, directive.Pos.Line, name)
+				if err := Parser.ParseString(source, text, callf); err != nil {
+					return err
+				}
+				sanitize(callf)
+				depth++
+				err = expandDirectives(callf.Directives)
+				depth--
+				if err != nil {
+					return err
+				}
+			} else if directive.If != nil {
+				branch, err := directive.If.Branch(f.Vars)
+				if err != nil {
+					return err
+				}
+				if err := expandDirectives(branch); err != nil {
+					return err
+				}
+			} else if directive.Include != "" {
+				files, err := f.resolveInclude(directive.Include)
+				if err != nil {
+					return &Error{Pos: directive.Pos, Msg: fmt.Sprintf("<%s: %s", directive.Include, err)}
+				}
+				if len(files) == 0 && f.opts.Remake && f.includes != nil && !isGlob(directive.Include) {
+					// A rule may make it. remakeIncludes reports it if
+					// not.
+					*f.includes = append(*f.includes, &includeRef{directive: directive, path: f.includePath(directive.Include), missing: true})
+					continue
+				}
+				if len(files) == 0 && !directive.optional {
+					return &Error{Pos: directive.Pos, Msg: fmt.Sprintf("<%s: file not found", directive.Include)}
+				}
+				if f.includes != nil {
+					for _, file := range files {
+						*f.includes = append(*f.includes, &includeRef{directive: directive, path: file})
+					}
+				}
+				if directive.namespace != "" {
+					if len(files) > 1 {
+						return &Error{Pos: directive.Pos, Msg: fmt.Sprintf("<%s: namespaced include matches %d files", directive.Include, len(files))}
+					}
+					for _, file := range files {
+						if err := f.includeNamespace(directive, file); err != nil {
+							return err
+						}
+					}
+					continue
+				}
+				for _, file := range files {
+					incf, err := f.include(directive, file)
+					if err != nil {
+						return err
+					}
+					incf.Vars = f.Vars
+					incf.namespaces = f.namespaces
+					incf.macros = f.macros
+					incf.calls = f.calls
+					incf.includes = f.includes
+					if err := expand(incf); err != nil {
+						return err
+					}
+					newDirectives = append(newDirectives, incf.Directives...)
+					f.redefined = append(f.redefined, incf.redefined...)
+					for k, rt := range incf.RuleTypes {
+						addRuleType(k, rt)
+					}
+				}
+			} else if directive.Var != nil {
+				f.Vars.Define(directive.Var)
+			} else if directive.RuleType != nil {
+				m, err := directive.RuleType.RuleType.Value()
+				if err != nil {
+					return err
+				}
+				addRuleType(m.String(), directive.RuleType)
+				//log.Printf("Have RuleType:")
+				//spew.Dump(directive.RuleType)
+			} else if directive.Rule != nil {
+				newDirectives = append(newDirectives, directive)
 			}
-			//log.Printf("Have Variable: %#v\n", directive.Var)
-			f.Vars = append(f.Vars, directive.Var)
-		} else if directive.RuleType != nil {
-			ruleTypes[directive.RuleType.RuleType.Value().String()] = directive.RuleType
-			//log.Printf("Have RuleType:")
-			//spew.Dump(directive.RuleType)
-		} else if directive.Rule != nil {
-			newDirectives = append(newDirectives, directive)
 		}
+		return nil
+	}
+	if err := expandDirectives(f.Directives); err != nil {
+		return err
 	}
 	f.RuleTypes = ruleTypes
 	f.Directives = newDirectives
 	return nil
 }
 
+// trimLine removes the tab that starts a rule body line, along with any
+// trailing whitespace. Further indentation is kept, since it is
+// significant to some interpreters.
+func trimLine(line string) string {
+	return strings.TrimRight(strings.TrimPrefix(line, "\t"), " \t\r")
+}
+
 func sanitize(f *File) {
-	for _, directive := range f.Directives {
+	sanitizeDirectives(f.Directives)
+}
+
+func sanitizeDirectives(directives []*Directive) {
+	for _, directive := range directives {
 		if directive.Include != "" {
-			directive.Include = strings.TrimSpace(directive.Include[1:])
+			inc := directive.Include[1:]
+			if strings.HasPrefix(inc, "?") {
+				directive.optional = true
+				inc = inc[1:]
+			}
+			directive.Include = strings.TrimSpace(inc)
+			if fields := strings.Fields(directive.Include); len(fields) == 3 && fields[1] == "as" {
+				directive.Include = fields[0]
+				directive.namespace = fields[2]
+			}
 		}
 		if directive.Rule != nil {
 			for _, section := range directive.Rule.RuleSections {
 				for i := range section.Lines {
-					section.Lines[i] = strings.TrimSpace(section.Lines[i])
+					section.Lines[i] = trimLine(section.Lines[i])
 				}
 			}
 		}
 		if directive.RuleType != nil {
 			for _, section := range directive.RuleType.RuleSections {
 				for i := range section.Lines {
-					section.Lines[i] = strings.TrimSpace(section.Lines[i])
+					section.Lines[i] = trimLine(section.Lines[i])
 				}
 			}
 		}
+		if c := directive.If; c != nil {
+			sanitizeDirectives(c.Then)
+			for _, elif := range c.Elifs {
+				sanitizeDirectives(elif.Then)
+			}
+			if c.Else != nil {
+				sanitizeDirectives(c.Else.Then)
+			}
+		}
 	}
 }
 
@@ -352,49 +1198,37 @@ func convert(f *File) (*RuleSets, error) {
 	if err != nil {
 		return nil, err
 	}
+	if errs := validate(f); len(errs) > 0 {
+		return nil, errs
+	}
 
 	var sets []*RuleSet
+	var defaultRule *RuleSet
+	var targetVars []*TargetVar
+	typeDefaults, err := ruleTypeDefaults(f)
+	if err != nil {
+		return nil, err
+	}
 	for _, d := range f.Directives {
 		defaults := make(map[string]*RuleSet)
-		for ruleType, rt := range f.RuleTypes {
-			rs := &RuleSet{Bodies: make([]*RuleBody, 0)}
-			for _, s := range rt.RuleSections {
-				var rb RuleBody
-				var ruleTypes []string
-				// for ruletype definitions, second part is
-				// *always* the type, third part is optional dependencies.
-				for i := 0; i < len(s.SecondPart); i++ {
-					ruleTypes = append(ruleTypes, s.SecondPart[i].Value().String())
-				}
-				if s.Colon != "" {
-					// We are using a non-nil Dependencies to differentiate between unspecified and
-					// specified but empty.
-					rb.Dependencies = make([]string, 0)
-				}
-				for i := 0; i < len(s.ThirdPart); i++ {
-					rb.Dependencies = append(rb.Dependencies, s.ThirdPart[i].Raw())
-				}
-				for i, t := range ruleTypes {
-					if i == 0 {
-						rb.RuleType = t
-					}
-					if t == "failok" {
-						rb.FailOK = true
-					}
-				}
-				rb.Lines = s.Lines
-				rs.Bodies = append(rs.Bodies, &rb)
-			}
-			defaults[ruleType] = rs
-		}
-
-		vars := make(map[string]string)
-		for _, v := range f.Vars {
-			vars[v.Name] = strings.Join(v.Value, " ")
+		for name, rs := range typeDefaults {
+			defaults[name] = rs.copy()
 		}
 
 		types := make(map[string]struct{})
-		rs := &RuleSet{Target: combineExpandElems(d.Rule.Target, vars).Value(), Bodies: make([]*RuleBody, 0)}
+		target, err := ruleTarget(d.Rule.Target, f.Vars.Get)
+		if err != nil {
+			return nil, err
+		}
+		if len(d.Rule.RuleSections) > 0 && isAssignment(d.Rule.RuleSections[0]) {
+			// validate has made sure every section is an assignment.
+			for _, s := range d.Rule.RuleSections {
+				v, inherit := s.assignment()
+				targetVars = append(targetVars, &TargetVar{Target: target, Var: v, Inherit: inherit})
+			}
+			continue
+		}
+		rs := &RuleSet{Pos: d.Rule.Pos, Target: target, Bodies: make([]*RuleBody, 0)}
 		for i, s := range d.Rule.RuleSections {
 			var rb RuleBody
 			var ruleTypes []string
@@ -406,8 +1240,9 @@ func convert(f *File) (*RuleSets, error) {
 			} else {
 				// Otherwise and in the remaining rule sections, second part is
 				// *always* the type, third part is optional dependencies.
-				for i := 0; i < len(s.SecondPart); i++ {
-					ruleTypes = append(ruleTypes, s.SecondPart[i].Value().String())
+				ruleTypes, err = elemStrings(s.SecondPart)
+				if err != nil {
+					return nil, err
 				}
 				if s.Colon == "" {
 					// for subsequent rules, if no dep list is specified, inherit from the first rule.
@@ -418,28 +1253,25 @@ func convert(f *File) (*RuleSets, error) {
 					}
 				}
 			}
-			for i, t := range ruleTypes {
-				if i == 0 {
-					rb.RuleType = t
-				}
-				if t == "failok" {
-					rb.FailOK = true
-				}
-			}
+			rb.setType(ruleTypes)
 
 			//ruleTypes[0] //strings.Join(ruleTypes, " ")
 			if _, ok := types[rb.RuleType]; ok {
-				return nil, fmt.Errorf("Duplicate definition for target %s", combineExpandElems(d.Rule.Target, vars).Value())
+				return nil, &Error{Pos: s.Pos, Msg: fmt.Sprintf("Duplicate definition for target %s", rs.Target)}
 			}
 			types[rb.RuleType] = struct{}{}
-			rb.Lines = s.Lines
+			rb.setLines(s.Lines)
 			rs.Bodies = append(rs.Bodies, &rb)
 		}
 		// apply any defaults
 		var additional []*RuleBody
+		from := make(map[string]string)
+		origin := make(map[string]string)
 		for i, body := range rs.Bodies {
 			if defaults, ok := defaults[body.RuleType]; ok {
+				body.Vars = defaults.Vars
 				for _, b := range defaults.Bodies {
+					b.Vars = defaults.Vars
 					if rs.Bodies[0].Dependencies != nil {
 						b.Dependencies = rs.Bodies[0].Dependencies
 					}
@@ -449,32 +1281,106 @@ func convert(f *File) (*RuleSets, error) {
 
 					if len(body.Lines) == 0 && b.RuleType == body.RuleType {
 						rs.Bodies[i] = b
-					} else {
-						additional = append(additional, b)
+						continue
+					}
+					if _, ok := types[b.RuleType]; ok {
+						continue
+					}
+					if other, ok := from[b.RuleType]; ok {
+						if origin[b.RuleType] == b.origin {
+							// Both ruletypes extend the one that defines it.
+							continue
+						}
+						return nil, &Error{Pos: d.Rule.Pos, Msg: fmt.Sprintf("Rule type %s for target %s is defined by both ruletype %s and ruletype %s", b.RuleType, rs.Target, other, body.RuleType)}
 					}
+					from[b.RuleType] = body.RuleType
+					origin[b.RuleType] = b.origin
+					additional = append(additional, b)
 				}
 			}
 		}
 		for _, body := range additional {
-			if _, ok := types[body.RuleType]; ok {
-				continue
-			}
 			types[body.RuleType] = struct{}{}
 			rs.Bodies = append(rs.Bodies, body)
 		}
+		if target.Str == defaultTarget {
+			for _, b := range rs.Bodies {
+				b.Fallback = true
+			}
+			defaultRule = rs
+			continue
+		}
 		sets = append(sets, rs)
 	}
 	// sets are searched in reverse read order.
 	for i, j := 0, len(sets)-1; i < j; i, j = i+1, j-1 {
 		sets[i], sets[j] = sets[j], sets[i]
 	}
-	return &RuleSets{f.Vars, sets}, nil
+	rs := &RuleSets{Vars: f.Vars, RuleSets: sets, TargetVars: targetVars, Namespaces: f.namespaces, Calls: *f.calls, Default: defaultRule, opts: f.opts, read: f.read}
+	for _, ns := range f.namespaces {
+		ns.parent = rs
+	}
+	return rs, nil
 }
 
 func Parse(file string) (*RuleSets, error) {
-	f, err := parseFile(file)
-	if err != nil {
-		return nil, err
+	return ParseOptions(file, Options{})
+}
+
+// Options control how an mmkfile is read.
+type Options struct {
+	// Vars are variables set on the command line. They take precedence
+	// over any definition in the mmkfile.
+	Vars map[string]string
+	// IncludePath lists directories to search for included files that are
+	// not found relative to the file including them.
+	IncludePath []string
+	// Recursive makes targets in a subdirectory containing an mmkfile
+	// refer to that mmkfile's rules, as if it had been included as a
+	// namespace named after the directory.
+	Recursive bool
+	// Remake builds included files that match rules before using them,
+	// and reads the mmkfile again if any of them change.
+	Remake bool
+	// Jobs is the number of jobs to run at once when remaking includes.
+	Jobs int
+}
+
+func ParseOptions(file string, opts Options) (*RuleSets, error) {
+	for reads := 1; ; reads++ {
+		f, err := parseFile(file)
+		if err != nil {
+			return nil, err
+		}
+		for name, value := range opts.Vars {
+			f.Vars.Override(name, value)
+		}
+		f.opts = opts
+		var includes []*includeRef
+		f.includes = &includes
+		var read []string
+		f.read = &read
+		rs, err := convert(f)
+		if err != nil {
+			return nil, err
+		}
+		if !opts.Remake {
+			rs.setSources(file, includes)
+			return rs, nil
+		}
+		changed, err := rs.remakeIncludes(includes)
+		if err != nil {
+			return nil, err
+		}
+		if !changed {
+			rs.setSources(file, includes)
+			return rs, nil
+		}
+		if reads == maxReads {
+			return nil, fmt.Errorf("%s was read %d times, and its includes are still changing", file, reads)
+		}
+		if Verbose {
+			log.Printf("Includes of %s changed. Reading it again.", file)
+		}
 	}
-	return convert(f)
 }
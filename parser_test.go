@@ -0,0 +1,70 @@
+package mmk
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// parseString parses text as an mmkfile.
+func parseString(t *testing.T, text string) (*RuleSets, error) {
+	t.Helper()
+	file := filepath.Join(t.TempDir(), "mmkfile")
+	if err := ioutil.WriteFile(file, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return Parse(file)
+}
+
+// Keywords are only recognised at the start of a line. Elsewhere they are
+// ordinary words.
+func TestKeywordDependencies(t *testing.T) {
+	for _, test := range []struct {
+		text string
+		deps []string
+	}{
+		{"main : foo end\n\techo main\n", []string{"foo", "end"}},
+		{"main : if x\n\techo main\n", []string{"if", "x"}},
+		{"main : elif x\n\techo main\n", []string{"elif", "x"}},
+		{"main : foo else\n\techo main\n", []string{"foo", "else"}},
+		{"main : end\n", []string{"end"}},
+		{"main : call x\n\techo main\n", []string{"call", "x"}},
+		{"main : macro x\n\techo main\n", []string{"macro", "x"}},
+		{"main : call\n\ncall :\n\techo call\n", []string{"call"}},
+	} {
+		rs, err := parseString(t, test.text)
+		if err != nil {
+			t.Errorf("%q: %s", test.text, err)
+			continue
+		}
+		rule := rs.RuleFor("main", "")
+		if rule == nil {
+			t.Errorf("%q: no rule for main", test.text)
+			continue
+		}
+		if deps := rule.SelectBody("").Dependencies; !reflect.DeepEqual(deps, test.deps) {
+			t.Errorf("%q: dependencies are %q, want %q", test.text, deps, test.deps)
+		}
+	}
+}
+
+func TestDuplicateRuleType(t *testing.T) {
+	_, err := parseString(t, "ruletype foo\n: foo\n\techo a\n\nruletype foo\n: foo\n\techo b\n")
+	if err == nil || !strings.Contains(err.Error(), "Duplicate definition of ruletype foo") {
+		t.Errorf("error is %v, want a duplicate ruletype", err)
+	}
+}
+
+func TestUnterminatedMacro(t *testing.T) {
+	for _, text := range []string{
+		"macro gobin name\n$name : main.go\n\tgo build -o $name\n\ncall gobin foo\n",
+		"main :\n\techo main\n\nmacro gobin",
+	} {
+		_, err := parseString(t, text)
+		if err == nil || !strings.Contains(err.Error(), "Unterminated macro gobin") {
+			t.Errorf("%q: error is %v, want an unterminated macro", text, err)
+		}
+	}
+}
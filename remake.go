@@ -0,0 +1,114 @@
+package mmk
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// maxReads limits how many times an mmkfile is read while remaking its
+// includes, so that includes which change every time they are built are
+// reported rather than remade forever.
+const maxReads = 10
+
+// An includeRef is a file included by an mmkfile.
+type includeRef struct {
+	directive *Directive
+	path      string
+	// missing is set if the file did not exist when it was included.
+	missing bool
+}
+
+// includePath returns the path of the file that an include of name in f
+// refers to, if it is made by a rule rather than found.
+func (f *File) includePath(name string) string {
+	if filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(filepath.Dir(f.Source), name)
+}
+
+// missingIncludes reports whether any file included by f did not exist,
+// and may be made by a rule.
+func (f *File) missingIncludes() bool {
+	if f.includes == nil {
+		return false
+	}
+	for _, inc := range *f.includes {
+		if inc.missing {
+			return true
+		}
+	}
+	return false
+}
+
+// remakeIncludes builds the included files that rules in r match, and
+// reports whether any of them changed. Missing files that no rule makes
+// are an error, unless they were included with "<?".
+func (r *RuleSets) remakeIncludes(includes []*includeRef) (bool, error) {
+	changed := false
+	for _, inc := range includes {
+		if rule, _ := r.ruleFor(inc.path, "", false); rule == nil {
+			if inc.missing && !inc.directive.optional {
+				return false, &Error{Pos: inc.directive.Pos, Msg: fmt.Sprintf("<%s: file not found", inc.directive.Include)}
+			}
+			continue
+		}
+		before := modTime(inc.path)
+		g, err := GenerateGraph(r, inc.path, "")
+		if err != nil {
+			return false, &Error{Pos: inc.directive.Pos, Msg: fmt.Sprintf("<%s: %s", inc.directive.Include, err)}
+		}
+		jobs := r.opts.Jobs
+		if jobs <= 0 {
+			jobs = 1
+		}
+		if err := g.Execute(jobs); err != nil {
+			return false, &Error{Pos: inc.directive.Pos, Msg: fmt.Sprintf("<%s: Failed to remake %s: %s", inc.directive.Include, inc.path, err)}
+		}
+		if inc.missing && !inc.directive.optional && !fileExists(inc.path) {
+			return false, &Error{Pos: inc.directive.Pos, Msg: fmt.Sprintf("<%s: the rule for %s did not make it", inc.directive.Include, inc.path)}
+		}
+		if after := modTime(inc.path); !after.Equal(before) {
+			changed = true
+		}
+	}
+	return changed, nil
+}
+
+// setSources records file and the files it includes as the sources of r.
+func (r *RuleSets) setSources(file string, includes []*includeRef) {
+	r.sources = []string{file}
+	for _, inc := range includes {
+		r.sources = append(r.sources, inc.path)
+	}
+}
+
+// addRead records file as read for r.
+func (r *RuleSets) addRead(file string) {
+	if r.read != nil {
+		*r.read = append(*r.read, file)
+	}
+}
+
+// sourceFiles returns the sources of r and every other file read for it
+// so far, including the mmkfiles of namespaces and of the subdirectories
+// that have been loaded.
+func (r *RuleSets) sourceFiles() []string {
+	files := r.sources
+	if r.read != nil {
+		files = append(files[:len(files):len(files)], *r.read...)
+	}
+	return files
+}
+
+// modTime returns the modification time of the named file, or the zero
+// time if it does not exist.
+func modTime(name string) time.Time {
+	stat, err := os.Stat(name)
+	if err != nil {
+		return time.Time{}
+	}
+	return stat.ModTime()
+}
@@ -0,0 +1,40 @@
+package mmk
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// An include that is yet to be made may define variables the mmkfile
+// uses. They are only checked once it has been made.
+func TestRemakeIncludeDefiningVariable(t *testing.T) {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Rules run in the current directory.
+	if err := os.Chdir(t.TempDir()); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chdir(wd)
+	text := "<gen.mmk\n\ngen.mmk :\n\techo 'var gen = foo' > gen.mmk\n\nmain : $gen\n\techo main\n"
+	if err := ioutil.WriteFile("mmkfile", []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+	rs, err := ParseOptions("mmkfile", Options{Remake: true, Jobs: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if gen := rs.Vars.Get("gen"); gen != "foo" {
+		t.Errorf("gen is %q, want %q", gen, "foo")
+	}
+
+	// Without remaking, the include is missing and so is the variable.
+	if err := os.Remove("gen.mmk"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseOptions("mmkfile", Options{}); err == nil {
+		t.Errorf("mmkfile with a missing include was read without remaking it")
+	}
+}
@@ -0,0 +1,150 @@
+package mmk
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// ruleTypeDefaults converts the ruletype definitions of f to RuleSets
+// holding their default bodies and variables, by ruletype name. Ruletypes
+// that extend others include the bodies and variables of those they
+// extend.
+func ruleTypeDefaults(f *File) (map[string]*RuleSet, error) {
+	own := make(map[string]*RuleSet)
+	for name, rt := range f.RuleTypes {
+		rs, err := rt.defaults()
+		if err != nil {
+			return nil, err
+		}
+		for _, b := range rs.Bodies {
+			b.origin = name
+		}
+		own[name] = rs
+	}
+	ret := make(map[string]*RuleSet)
+	var resolve func(name string, chain []string) (*RuleSet, error)
+	resolve = func(name string, chain []string) (*RuleSet, error) {
+		if rs, ok := ret[name]; ok {
+			return rs, nil
+		}
+		rt := f.RuleTypes[name]
+		for i, c := range chain {
+			if c == name {
+				return nil, &Error{Pos: rt.Pos, Msg: fmt.Sprintf("Ruletype %s extends itself: %s -> %s", name, strings.Join(chain[i:], " -> "), name)}
+			}
+		}
+		chain = append(chain, name)
+		if len(rt.Extends) == 0 {
+			ret[name] = own[name]
+			return own[name], nil
+		}
+		ownTypes := make(map[string]struct{})
+		for _, b := range own[name].Bodies {
+			ownTypes[b.RuleType] = struct{}{}
+		}
+		rs := &RuleSet{Bodies: make([]*RuleBody, 0)}
+		index := make(map[string]int)
+		from := make(map[string]string)
+		add := func(b *RuleBody, base string) error {
+			i, ok := index[b.RuleType]
+			if !ok {
+				index[b.RuleType] = len(rs.Bodies)
+				from[b.RuleType] = base
+				rs.Bodies = append(rs.Bodies, b)
+				return nil
+			}
+			// Bases that extend the same ruletype both provide its
+			// bodies, which is not a conflict.
+			if base != "" && from[b.RuleType] != base && rs.Bodies[i].origin != b.origin {
+				if _, ok := ownTypes[b.RuleType]; !ok {
+					return &Error{Pos: rt.Pos, Msg: fmt.Sprintf("Ruletype %s inherits rule type %s from both %s and %s", name, b.RuleType, from[b.RuleType], base)}
+				}
+			}
+			from[b.RuleType] = base
+			rs.Bodies[i] = b
+			return nil
+		}
+		for i, e := range rt.Extends {
+			base := e.Raw()
+			if _, ok := f.RuleTypes[base]; !ok {
+				return nil, &Error{Pos: e.Pos, Msg: fmt.Sprintf("Ruletype %s extends undefined ruletype %s", name, base)}
+			}
+			brs, err := resolve(base, chain)
+			if err != nil {
+				return nil, err
+			}
+			rs.Vars = append(rs.Vars, brs.Vars...)
+			for _, b := range brs.Bodies {
+				c := *b
+				// The first base's own rule type becomes this
+				// ruletype's. Other bases keep theirs.
+				if i == 0 && c.RuleType == base {
+					c.RuleType = name
+				}
+				if err := add(&c, base); err != nil {
+					return nil, err
+				}
+			}
+		}
+		rs.Vars = append(rs.Vars, own[name].Vars...)
+		for _, b := range own[name].Bodies {
+			add(b, "")
+		}
+		ret[name] = rs
+		return rs, nil
+	}
+	var names []string
+	for name := range f.RuleTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, err := resolve(name, nil); err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+// defaults converts the sections of rt to a RuleSet with no target.
+func (rt *RuleType) defaults() (*RuleSet, error) {
+	rs := &RuleSet{Bodies: make([]*RuleBody, 0)}
+	for _, s := range rt.RuleSections {
+		if isAssignment(s) {
+			v, _ := s.assignment()
+			rs.Vars = append(rs.Vars, v)
+			continue
+		}
+		var rb RuleBody
+		// for ruletype definitions, second part is
+		// *always* the type, third part is optional dependencies.
+		ruleTypes, err := elemStrings(s.SecondPart)
+		if err != nil {
+			return nil, err
+		}
+		if s.Colon != "" {
+			// We are using a non-nil Dependencies to differentiate between unspecified and
+			// specified but empty.
+			rb.Dependencies = make([]string, 0)
+		}
+		for i := 0; i < len(s.ThirdPart); i++ {
+			rb.Dependencies = append(rb.Dependencies, s.ThirdPart[i].Raw())
+		}
+		rb.setType(ruleTypes)
+		rb.setLines(s.Lines)
+		rs.Bodies = append(rs.Bodies, &rb)
+	}
+	return rs, nil
+}
+
+// copy returns a copy of rs whose bodies may be modified without
+// affecting rs.
+func (rs *RuleSet) copy() *RuleSet {
+	c := &RuleSet{Target: rs.Target, Bodies: make([]*RuleBody, len(rs.Bodies)), Vars: rs.Vars}
+	for i, b := range rs.Bodies {
+		cb := *b
+		c.Bodies[i] = &cb
+	}
+	return c
+}
@@ -0,0 +1,157 @@
+package mmk
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// StateFile is the file, relative to the current directory, in which mmk
+// keeps what it learns while building, such as the dependencies read from
+// depfiles.
+var StateFile = ".mmk.state"
+
+// A State holds what mmk has learned about targets in earlier builds.
+type State struct {
+	sync.Mutex
+	// Deps holds the dependencies discovered for each node, by the node's
+	// key, "target:ruletype".
+	Deps map[string][]string `json:"deps"`
+}
+
+var (
+	state     *State
+	stateOnce sync.Once
+)
+
+// loadState returns the state read from StateFile. The file is only read
+// once. If it does not exist or cannot be read, the state is empty.
+func loadState() *State {
+	stateOnce.Do(func() {
+		state = &State{Deps: make(map[string][]string)}
+		bs, err := ioutil.ReadFile(StateFile)
+		if err != nil {
+			if !os.IsNotExist(err) {
+				log.Printf("Failed to read %s: %s", StateFile, err)
+			}
+			return
+		}
+		if err := json.Unmarshal(bs, state); err != nil {
+			log.Printf("Failed to read %s: %s", StateFile, err)
+		}
+		if state.Deps == nil {
+			state.Deps = make(map[string][]string)
+		}
+	})
+	return state
+}
+
+// deps returns the dependencies discovered for the node with key.
+func (s *State) deps(key string) []string {
+	s.Lock()
+	defer s.Unlock()
+	return s.Deps[key]
+}
+
+// setDeps records the dependencies discovered for the node with key, and
+// writes the state to StateFile.
+func (s *State) setDeps(key string, deps []string) error {
+	s.Lock()
+	defer s.Unlock()
+	if len(deps) == 0 {
+		delete(s.Deps, key)
+	} else {
+		s.Deps[key] = deps
+	}
+	bs, err := json.MarshalIndent(s, "", "\t")
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first, so that an interrupted build does
+	// not leave a truncated state behind.
+	tmp := StateFile + ".tmp"
+	if err := ioutil.WriteFile(tmp, bs, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, StateFile)
+}
+
+// parseDepfile returns the prerequisites listed in a depfile, in the
+// Makefile format written by "gcc -MD" and similar compilers. The
+// prerequisites of every rule in the file are returned, without
+// duplicates, and excluding the targets themselves.
+func parseDepfile(text string) []string {
+	text = strings.ReplaceAll(text, "\\\r\n", " ")
+	text = strings.ReplaceAll(text, "\\\n", " ")
+	var targets, prereqs []string
+	for _, line := range strings.Split(text, "\n") {
+		words := depfileWords(line)
+		for i, w := range words {
+			if strings.HasSuffix(w, ":") {
+				targets = append(targets, words[:i]...)
+				targets = append(targets, strings.TrimSuffix(w, ":"))
+				prereqs = append(prereqs, words[i+1:]...)
+				break
+			}
+		}
+	}
+	isTarget := make(map[string]struct{})
+	for _, t := range targets {
+		isTarget[t] = struct{}{}
+	}
+	seen := make(map[string]struct{})
+	var ret []string
+	for _, p := range prereqs {
+		if _, ok := isTarget[p]; ok {
+			continue
+		}
+		if _, ok := seen[p]; ok {
+			continue
+		}
+		seen[p] = struct{}{}
+		ret = append(ret, p)
+	}
+	sort.Strings(ret)
+	return ret
+}
+
+// depfileWords splits a line of a depfile into words. A backslash escapes
+// a space or '#', and "$$" stands for '$'. The targets of a rule end with
+// a word ending in ':'. Comments are dropped.
+func depfileWords(line string) []string {
+	var words []string
+	var b strings.Builder
+	flush := func() {
+		if b.Len() > 0 {
+			words = append(words, b.String())
+			b.Reset()
+		}
+	}
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case c == '\\' && i+1 < len(line) && (line[i+1] == ' ' || line[i+1] == '#'):
+			b.WriteByte(line[i+1])
+			i++
+		case c == '$' && i+1 < len(line) && line[i+1] == '$':
+			b.WriteByte('$')
+			i++
+		case c == '#':
+			flush()
+			return words
+		case c == ' ' || c == '\t' || c == '\r':
+			flush()
+		case c == ':' && (i+1 == len(line) || line[i+1] == ' ' || line[i+1] == '\t'):
+			b.WriteByte(c)
+			flush()
+		default:
+			b.WriteByte(c)
+		}
+	}
+	flush()
+	return words
+}
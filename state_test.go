@@ -0,0 +1,30 @@
+package mmk
+
+import (
+	"reflect"
+	"testing"
+)
+
+// Prerequisites are returned sorted.
+func TestParseDepfile(t *testing.T) {
+	for _, test := range []struct {
+		text string
+		deps []string
+	}{
+		{"foo.o: foo.c foo.h\n", []string{"foo.c", "foo.h"}},
+		{"foo.o: foo.c \\\n  foo.h \\\r\n  bar.h\n", []string{"bar.h", "foo.c", "foo.h"}},
+		{"foo.o bar.o: a.h\n", []string{"a.h"}},
+		{"foo.o: a.h a.h\nfoo.o: a.h b.h\n", []string{"a.h", "b.h"}},
+		// Targets of other rules, such as phony rules for headers, are
+		// not dependencies.
+		{"foo.o: foo.c foo.h\nfoo.h:\n", []string{"foo.c"}},
+		{"foo.o: my\\ file.h # comment\n", []string{"my file.h"}},
+		{"foo.o: a\\#b.h cost$$.h\n", []string{"a#b.h", "cost$.h"}},
+		{`foo.o: C:\src\foo.c` + "\n", []string{`C:\src\foo.c`}},
+		{"", nil},
+	} {
+		if deps := parseDepfile(test.text); !reflect.DeepEqual(deps, test.deps) {
+			t.Errorf("parseDepfile(%q) = %q, want %q", test.text, deps, test.deps)
+		}
+	}
+}
@@ -0,0 +1,260 @@
+package mmk
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/alecthomas/participle/v2/lexer"
+)
+
+// An Error is a problem found in an mmkfile at a particular position.
+type Error struct {
+	Pos lexer.Position
+	Msg string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s: %s", e.Pos, e.Msg)
+}
+
+// ErrorList is a list of problems found in an mmkfile.
+type ErrorList []*Error
+
+func (l ErrorList) Error() string {
+	msgs := make([]string, len(l))
+	for i, e := range l {
+		msgs[i] = e.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+func (l *ErrorList) add(pos lexer.Position, format string, args ...interface{}) {
+	*l = append(*l, &Error{Pos: pos, Msg: fmt.Sprintf(format, args...)})
+}
+
+var matchVar = regexp.MustCompile(`^match_([0-9]+)$`)
+
+// validate checks an expanded file for problems that would otherwise only
+// show up when a rule is used, or not at all. It reports every problem it
+// finds.
+func validate(f *File) ErrorList {
+	var errs ErrorList
+	// Target-specific and ruletype variables may be used wherever a rule
+	// could see them.
+	scoped := make(map[string]struct{})
+	for _, rt := range f.RuleTypes {
+		for _, s := range rt.RuleSections {
+			if v, _ := s.assignment(); v != nil {
+				scoped[v.Name] = struct{}{}
+			}
+		}
+	}
+	for _, d := range f.Directives {
+		if d.Rule == nil {
+			continue
+		}
+		for _, s := range d.Rule.RuleSections {
+			if v, _ := s.assignment(); v != nil {
+				scoped[v.Name] = struct{}{}
+			}
+		}
+	}
+	// Variables may be defined by included files that are yet to be
+	// made, so they are only checked once those files exist.
+	pending := f.missingIncludes()
+	defined := func(name string) bool {
+		_, ok := scoped[name]
+		return ok || pending || f.Vars.Has(name)
+	}
+	checkAssignment := func(s *RuleSection) {
+		if len(s.Lines) > 0 {
+			v, _ := s.assignment()
+			errs.add(s.Pos, "Assignment to %s cannot have a rule body", v.Name)
+		}
+	}
+	checkVars := func(e *Elem, what string) {
+		for _, name := range varRefs(e.Any) {
+			if _, err := strconv.Atoi(name); err == nil {
+				continue
+			}
+			if !pending && !f.Vars.Has(name) {
+				errs.add(e.Pos, "Undefined variable $%s in %s", name, what)
+			}
+		}
+	}
+	checkRegex := func(e *Elem) {
+		if _, err := e.Value(); err != nil {
+			errs = append(errs, err.(*Error))
+		}
+	}
+	// checkCapture checks a reference to capture group n of target. target
+	// is nil for ruletype definitions, whose targets are not known.
+	checkCapture := func(e *Elem, ref string, n int, target *Matcher) {
+		switch {
+		case target == nil:
+		case target.Regex == nil:
+			errs.add(e.Pos, "%s refers to a capture group, but target %s is not a regular expression", ref, target)
+		case n > target.Regex.NumSubexp():
+			errs.add(e.Pos, "%s refers to capture group %d, but target %s has %d", ref, n, target, target.Regex.NumSubexp())
+		}
+	}
+	checkDep := func(e *Elem, target *Matcher) {
+		if e.Regex != "" {
+			for _, name := range varRefs(strings.Trim(e.Regex, `'`)) {
+				if n, err := strconv.Atoi(name); err == nil {
+					checkCapture(e, "$"+name, n, target)
+				} else if !defined(name) && name != "target" {
+					errs.add(e.Pos, "Undefined variable $%s in dependency %s", name, e.Regex)
+				}
+			}
+			return
+		}
+		for _, name := range varRefs(e.Any) {
+			if _, err := strconv.Atoi(name); err == nil {
+				continue
+			}
+			if m := matchVar.FindStringSubmatch(name); m != nil {
+				n, _ := strconv.Atoi(m[1])
+				checkCapture(e, "$"+name, n, target)
+			} else if !defined(name) && name != "target" {
+				errs.add(e.Pos, "Undefined variable $%s in dependency", name)
+			}
+		}
+	}
+	checkSection := func(s *RuleSection, typed bool, target *Matcher) {
+		if typed {
+			types := s.SecondPart
+			for i := range types {
+				checkRegex(&types[i])
+				if i > 0 && !isRuleFlag(types[i].Raw()) {
+					errs.add(types[i].Pos, "Unknown flag %s", types[i].Raw())
+				}
+			}
+		} else {
+			for i := range s.SecondPart {
+				checkDep(&s.SecondPart[i], target)
+			}
+		}
+		for i := range s.ThirdPart {
+			checkDep(&s.ThirdPart[i], target)
+		}
+		deps := s.ThirdPart
+		if !typed {
+			deps = append(s.SecondPart[:len(s.SecondPart):len(s.SecondPart)], deps...)
+		}
+		seps := 0
+		for i := range deps {
+			if deps[i].Raw() == orderOnlySep {
+				if seps++; seps == 2 {
+					errs.add(deps[i].Pos, "Dependencies may only have one %s separating order-only dependencies", orderOnlySep)
+				}
+			}
+		}
+	}
+	sectionType := func(s *RuleSection) string {
+		if len(s.SecondPart) == 0 || isRuleFlag(s.SecondPart[0].Raw()) {
+			return ""
+		}
+		return s.SecondPart[0].Raw()
+	}
+
+	for _, pair := range f.redefined {
+		errs.add(pair[1].Pos, "Duplicate definition of ruletype %s, first defined at %s", pair[1].RuleType.Raw(), pair[0].Pos)
+	}
+	var names []string
+	for name := range f.RuleTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		rt := f.RuleTypes[name]
+		types := make(map[string]struct{})
+		for _, s := range rt.RuleSections {
+			if isAssignment(s) {
+				checkAssignment(s)
+				continue
+			}
+			checkSection(s, true, nil)
+			t := sectionType(s)
+			if _, ok := types[t]; ok {
+				errs.add(s.Pos, "Duplicate definition of rule type %s in ruletype %s", t, rt.RuleType.Raw())
+			}
+			types[t] = struct{}{}
+		}
+	}
+	for _, d := range f.Directives {
+		if d.Rule == nil {
+			continue
+		}
+		if len(d.Rule.Target) == 0 {
+			errs.add(d.Rule.Pos, "Rule has no target")
+			continue
+		}
+		for _, e := range d.Rule.Target {
+			checkVars(e, "target")
+		}
+		combined := *d.Rule.Target[0]
+		target := &combined
+		for _, e := range d.Rule.Target[1:] {
+			target = target.Combine(e)
+		}
+		m, err := target.Value()
+		if err != nil {
+			errs = append(errs, err.(*Error))
+			continue
+		}
+		if len(d.Rule.RuleSections) > 0 && isAssignment(d.Rule.RuleSections[0]) {
+			for _, s := range d.Rule.RuleSections {
+				if isAssignment(s) {
+					checkAssignment(s)
+				} else {
+					errs.add(s.Pos, "Rule for %s mixes variable assignments and rule sections", targetString(d.Rule.Target))
+				}
+			}
+			continue
+		}
+		types := make(map[string]struct{})
+		for i, s := range d.Rule.RuleSections {
+			if isAssignment(s) {
+				errs.add(s.Pos, "Rule for %s mixes variable assignments and rule sections", targetString(d.Rule.Target))
+				continue
+			}
+			typed := i > 0 || s.Colon != ""
+			checkSection(s, typed, m)
+			t := ""
+			if typed {
+				t = sectionType(s)
+			}
+			if _, ok := types[t]; ok {
+				errs.add(s.Pos, "Duplicate definition of rule type %s for target %s", t, targetString(d.Rule.Target))
+			}
+			types[t] = struct{}{}
+		}
+	}
+	return errs
+}
+
+// varRefs returns the names of the variables referenced in s, including
+// positional references like $1.
+func varRefs(s string) []string {
+	var names []string
+	expandText(s, func(name string) string {
+		if name != "" && isNameChar(name[0]) {
+			names = append(names, name)
+		}
+		return ""
+	}, nil)
+	return names
+}
+
+// targetString returns the target as it was written in the mmkfile.
+func targetString(es []*Elem) string {
+	var parts []string
+	for _, e := range es {
+		parts = append(parts, e.Raw())
+	}
+	return strings.Join(parts, "")
+}
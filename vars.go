@@ -0,0 +1,372 @@
+package mmk
+
+import (
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+)
+
+// Vars holds the variables defined by an mmkfile. Variables defined with
+// "=" are evaluated the first time they are used, so lookups may run shell
+// commands. Vars is safe for concurrent use.
+type Vars struct {
+	sync.Mutex
+	parent *Vars
+	names  []string
+	vars   map[string]*Var
+}
+
+func NewVars() *Vars {
+	return &Vars{vars: make(map[string]*Var)}
+}
+
+// Scope returns a new, empty set of variables inside vs. Variables defined
+// in the new set hide those of the same name in vs, and appending to a
+// variable of vs appends to its value without changing vs.
+func (vs *Vars) Scope() *Vars {
+	return &Vars{parent: vs, vars: make(map[string]*Var)}
+}
+
+// Define adds v to the set according to its operator:
+//
+//	=   defines v, to be evaluated when it is first used.
+//	:=  evaluates v immediately.
+//	+=  appends to an existing variable. The appended value is evaluated
+//	    immediately if the variable was defined with :=, and lazily
+//	    otherwise.
+//	?=  defines v only if it is not already defined.
+//
+// Definitions of variables set with Override are ignored. If v is set in
+// the environment, other than by the mmk running this one, the
+// environment's value is used instead of v's, except by +=.
+//
+// v itself is not modified, so the same Var may be defined in several sets.
+func (vs *Vars) Define(v *Var) {
+	v = &Var{Pos: v.Pos, Name: v.Name, Op: v.Op, Value: v.Value}
+	if vs.overridden(v.Name) {
+		return
+	}
+	if ok, _ := vs.defined(v.Name); ok && v.Op == "?=" {
+		return
+	}
+	if value, ok := lookupEnv(v.Name); ok && v.Op != "+=" {
+		v = &Var{Pos: v.Pos, Name: v.Name, Op: "=", Value: []string{value}, fromEnv: true, immediate: true, evaluated: true, value: value}
+	}
+	var inParent, parentImmediate bool
+	if vs.parent != nil && v.Op == "+=" {
+		inParent, parentImmediate = vs.parent.defined(v.Name)
+	}
+	vs.Lock()
+	defer vs.Unlock()
+	old, ok := vs.vars[v.Name]
+	if !ok {
+		vs.names = append(vs.names, v.Name)
+	}
+	switch {
+	case v.Op == "+=" && ok:
+		if old.immediate {
+			old.value = appendValue(old.value, vs.evalRaw(v))
+		} else {
+			old.appended = append(old.appended, v)
+			old.evaluated = false
+		}
+	case v.Op == "+=" && inParent && parentImmediate:
+		v.immediate = true
+		v.value = appendValue(vs.parent.Get(v.Name), vs.evalRaw(v))
+		v.evaluated = true
+		vs.vars[v.Name] = v
+	case v.Op == "+=" && inParent:
+		v.extends = true
+		vs.vars[v.Name] = v
+	case v.Op == ":=":
+		v.immediate = true
+		v.value = vs.evalRaw(v)
+		v.evaluated = true
+		vs.vars[v.Name] = v
+	default:
+		vs.vars[v.Name] = v
+	}
+}
+
+// Override sets the named variable to value, which is used as-is. Later
+// definitions of the variable, including those in scopes inside vs, are
+// ignored.
+func (vs *Vars) Override(name, value string) {
+	vs.Lock()
+	defer vs.Unlock()
+	if _, ok := vs.vars[name]; !ok {
+		vs.names = append(vs.names, name)
+	}
+	vs.vars[name] = &Var{
+		Name:      name,
+		Op:        "=",
+		Value:     []string{value},
+		override:  true,
+		immediate: true,
+		evaluated: true,
+		value:     value,
+	}
+}
+
+func (vs *Vars) overridden(name string) bool {
+	vs.Lock()
+	v, ok := vs.vars[name]
+	vs.Unlock()
+	if ok {
+		return v.override
+	}
+	if vs.parent != nil {
+		return vs.parent.overridden(name)
+	}
+	return false
+}
+
+// Lookup returns the value of the named variable, evaluating it if
+// necessary.
+func (vs *Vars) Lookup(name string) (string, bool) {
+	vs.Lock()
+	defer vs.Unlock()
+	return vs.lookup(name)
+}
+
+// Get returns the value of the named variable, or the empty string if it
+// is not defined.
+func (vs *Vars) Get(name string) string {
+	value, _ := vs.Lookup(name)
+	return value
+}
+
+// Words returns the value of the named variable as a list. The value is
+// split on whitespace, and double-quoted strings are single elements.
+func (vs *Vars) Words(name string) []string {
+	return splitWords(vs.Get(name))
+}
+
+// Has reports whether the named variable is defined.
+func (vs *Vars) Has(name string) bool {
+	ok, _ := vs.defined(name)
+	return ok
+}
+
+// defined reports whether the named variable is defined in vs or the sets
+// it is inside of, and whether it was defined with :=.
+func (vs *Vars) defined(name string) (bool, bool) {
+	vs.Lock()
+	v, ok := vs.vars[name]
+	vs.Unlock()
+	if ok {
+		return true, v.immediate
+	}
+	if vs.parent != nil {
+		return vs.parent.defined(name)
+	}
+	return false, false
+}
+
+// List returns the variables in the order they were first defined. Their
+// values are not evaluated. Variables of enclosing sets are not included.
+func (vs *Vars) List() []*Var {
+	vs.Lock()
+	defer vs.Unlock()
+	ret := make([]*Var, 0, len(vs.names))
+	for _, name := range vs.names {
+		ret = append(ret, vs.vars[name])
+	}
+	return ret
+}
+
+// Environ evaluates every variable and returns them in "name=value" form.
+func (vs *Vars) Environ() []string {
+	return vs.environ(nil)
+}
+
+// environ is like Environ, but if used is not nil, variables defined with
+// "=" are left out, and not evaluated, unless used reports that they are
+// used.
+func (vs *Vars) environ(used func(name string) bool) []string {
+	var ret []string
+	if vs.parent != nil {
+		ret = vs.parent.environ(used)
+	}
+	vs.Lock()
+	defer vs.Unlock()
+	for _, name := range vs.names {
+		if used != nil && !vs.vars[name].immediate && !used(name) {
+			ret = unsetEnv(ret, name)
+			continue
+		}
+		value, _ := vs.lookup(name)
+		ret = setEnv(ret, name, value)
+	}
+	return ret
+}
+
+// unsetEnv removes name from env, which is in "name=value" form.
+func unsetEnv(env []string, name string) []string {
+	for i, e := range env {
+		if strings.HasPrefix(e, name+"=") {
+			return append(env[:i:i], env[i+1:]...)
+		}
+	}
+	return env
+}
+
+// mmkVarsEnv names the environment variable listing the variables that
+// rule bodies are given from the mmkfile, so that an mmk run by a rule
+// body does not take them for the user's.
+const mmkVarsEnv = "mmk_vars"
+
+// lookupEnv returns the value of the named environment variable, unless it
+// was set from the mmkfile of the mmk running this one.
+func lookupEnv(name string) (string, bool) {
+	for _, n := range strings.Fields(os.Getenv(mmkVarsEnv)) {
+		if n == name {
+			return "", false
+		}
+	}
+	return os.LookupEnv(name)
+}
+
+// mmkfileNames returns the names of the variables whose values come from
+// the mmkfile, rather than the environment or the command line.
+func (vs *Vars) mmkfileNames() []string {
+	var names []string
+	if vs.parent != nil {
+		names = vs.parent.mmkfileNames()
+	}
+	vs.Lock()
+	defer vs.Unlock()
+	for _, name := range vs.names {
+		if v := vs.vars[name]; !v.fromEnv && !v.override {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// setEnv sets name to value in env, which is in "name=value" form.
+func setEnv(env []string, name, value string) []string {
+	for i, e := range env {
+		if strings.HasPrefix(e, name+"=") {
+			env[i] = name + "=" + value
+			return env
+		}
+	}
+	return append(env, name+"="+value)
+}
+
+func (vs *Vars) lookup(name string) (string, bool) {
+	v, ok := vs.vars[name]
+	if !ok {
+		if vs.parent != nil {
+			return vs.parent.Lookup(name)
+		}
+		return "", false
+	}
+	if v.evaluated {
+		return v.value, true
+	}
+	if v.evaluating {
+		log.Printf("%s: Variable %s refers to itself", v.Pos, v.Name)
+		return "", true
+	}
+	v.evaluating = true
+	value := vs.evalRaw(v)
+	if v.extends {
+		value = appendValue(vs.parent.Get(v.Name), value)
+	}
+	for _, a := range v.appended {
+		value = appendValue(value, vs.evalRaw(a))
+	}
+	v.evaluating = false
+	v.evaluated = true
+	v.value = value
+	return value, true
+}
+
+func appendValue(value, more string) string {
+	if value == "" {
+		return more
+	}
+	if more == "" {
+		return value
+	}
+	return value + " " + more
+}
+
+// Expand expands references to variables and builtin function calls in s.
+// Names that are not variables are looked up in the environment.
+func (vs *Vars) Expand(s string) string {
+	vs.Lock()
+	defer vs.Unlock()
+	return vs.interpolate(s, logError)
+}
+
+// ExpandCommand expands references to variables and builtin function calls
+// in the shell command cmd. References to names that are not variables are
+// left for the shell.
+func (vs *Vars) ExpandCommand(cmd string) string {
+	vs.Lock()
+	defer vs.Unlock()
+	return vs.interpolateCommand(cmd, logError)
+}
+
+func logError(err error) {
+	log.Printf("Error: %s", err)
+}
+
+func (vs *Vars) interpolate(s string, onError func(error)) string {
+	return expandText(s, func(name string) string {
+		if value, ok := vs.lookup(name); ok {
+			return value
+		}
+		return os.Getenv(name)
+	}, onError)
+}
+
+func (vs *Vars) interpolateCommand(cmd string, onError func(error)) string {
+	return expandText(cmd, func(name string) string {
+		if value, ok := vs.lookup(name); ok {
+			return value
+		}
+		return "${" + name + "}"
+	}, onError)
+}
+
+// evalRaw evaluates a variable's value as written in the mmkfile. A value
+// of the form $(command) is replaced by the output of command. Otherwise,
+// references to other variables and builtin function calls are expanded.
+func (vs *Vars) evalRaw(v *Var) string {
+	onError := func(err error) {
+		log.Printf("%s: %s", v.Pos, err)
+	}
+	joined := strings.Join(v.Value, " ")
+	if cmdBody, ok := commandSubst(joined); ok {
+		cmdBody = vs.interpolateCommand(cmdBody, onError)
+		output, err := shellOutput(cmdBody)
+		if err != nil {
+			log.Printf("%s Error: %s", cmdBody, err)
+			return ""
+		}
+		return strings.TrimSpace(output)
+	}
+	return vs.interpolate(joined, onError)
+}
+
+// commandSubst returns the command in s if s is of the form $(command).
+func commandSubst(s string) (string, bool) {
+	if strings.HasPrefix(s, "$(") && strings.HasSuffix(s, ")") {
+		return s[2 : len(s)-1], true
+	}
+	return "", false
+}
+
+// shellOutput runs cmd with bash and returns its standard output.
+func shellOutput(cmd string) (string, error) {
+	c := exec.Command("bash", "-c", cmd)
+	c.Stderr = os.Stderr
+	output, err := c.Output()
+	return string(output), err
+}
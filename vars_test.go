@@ -0,0 +1,67 @@
+package mmk
+
+import (
+	"os"
+	"testing"
+)
+
+// TestVarPrecedence checks where the value of $x comes from: the command
+// line, then the environment, then the mmkfile, then ?= definitions.
+func TestVarPrecedence(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		env  map[string]string
+		cli  map[string]string
+		defs [][2]string
+		want string
+	}{
+		{name: "mmkfile", defs: [][2]string{{"=", "a"}}, want: "a"},
+		{name: "later definition", defs: [][2]string{{"=", "a"}, {":=", "b"}}, want: "b"},
+		{name: "default", defs: [][2]string{{"?=", "a"}}, want: "a"},
+		{name: "default after definition", defs: [][2]string{{"=", "a"}, {"?=", "b"}}, want: "a"},
+		{name: "append", defs: [][2]string{{"=", "a"}, {"+=", "b"}}, want: "a b"},
+		{name: "environment over =", env: map[string]string{"x": "e"}, defs: [][2]string{{"=", "a"}}, want: "e"},
+		{name: "environment over :=", env: map[string]string{"x": "e"}, defs: [][2]string{{":=", "a"}}, want: "e"},
+		{name: "environment over ?=", env: map[string]string{"x": "e"}, defs: [][2]string{{"?=", "a"}}, want: "e"},
+		{name: "append to environment", env: map[string]string{"x": "e"}, defs: [][2]string{{"=", "a"}, {"+=", "b"}}, want: "e b"},
+		{name: "command line over environment", env: map[string]string{"x": "e"}, cli: map[string]string{"x": "c"}, defs: [][2]string{{"=", "a"}}, want: "c"},
+		{name: "command line over append", cli: map[string]string{"x": "c"}, defs: [][2]string{{"=", "a"}, {"+=", "b"}}, want: "c"},
+		{name: "exported by mmk", env: map[string]string{"x": "e", mmkVarsEnv: "y x"}, defs: [][2]string{{"=", "a"}}, want: "a"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			for name, value := range test.env {
+				old, ok := os.LookupEnv(name)
+				os.Setenv(name, value)
+				if ok {
+					defer os.Setenv(name, old)
+				} else {
+					defer os.Unsetenv(name)
+				}
+			}
+			vs := NewVars()
+			for name, value := range test.cli {
+				vs.Override(name, value)
+			}
+			for _, d := range test.defs {
+				vs.Define(&Var{Name: "x", Op: d[0], Value: []string{d[1]}})
+			}
+			if got := vs.Get("x"); got != test.want {
+				t.Errorf("x is %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+// Target-specific definitions are scopes inside the global variables.
+func TestVarScope(t *testing.T) {
+	vs := NewVars()
+	vs.Define(&Var{Name: "x", Op: ":=", Value: []string{"a"}})
+	scope := vs.Scope()
+	scope.Define(&Var{Name: "x", Op: "+=", Value: []string{"b"}})
+	if got := scope.Get("x"); got != "a b" {
+		t.Errorf("x in scope is %q, want %q", got, "a b")
+	}
+	if got := vs.Get("x"); got != "a" {
+		t.Errorf("x is %q, want %q", got, "a")
+	}
+}
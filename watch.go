@@ -0,0 +1,303 @@
+package mmk
+
+import (
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// watchQuiet is how long files must go unchanged before a rebuild
+	// starts, so that a burst of changes, such as an editor saving several
+	// files, causes a single rebuild.
+	watchQuiet = 200 * time.Millisecond
+	// pollInterval is how often files are checked when they cannot be
+	// watched with inotify.
+	pollInterval = time.Second
+)
+
+// A watcher reports changes to a set of files.
+type watcher interface {
+	// Watch replaces the files being watched with paths.
+	Watch(paths []string) error
+	// Changes receives a value when a watched file may have changed.
+	Changes() <-chan struct{}
+	Close() error
+}
+
+// Watch builds goals with the rules in rs, and then watches the files
+// they depend on, rebuilding the targets those files affect whenever they
+// change. If the mmkfile rs was read from, or any other file read for it,
+// such as an include or the mmkfile of a subdirectory, changes, it is read
+// again with the same options, and every goal is rebuilt. Watch only returns if the files cannot be watched. Build errors
+// are logged, and the files are watched as before.
+func Watch(rs *RuleSets, goals []Goal, njobs int) error {
+	w, err := newWatcher()
+	if err != nil {
+		if Verbose {
+			log.Printf("Polling for changes, since files cannot be watched: %s", err)
+		}
+		w = newPoller(pollInterval)
+	}
+	defer w.Close()
+
+	file, opts := rs.sources[0], rs.opts
+	mmkfiles := snapshot(rs.sourceFiles())
+	var sources map[string]time.Time
+	for {
+		if err := rs.rebuild(goals, &sources, njobs); err != nil {
+			log.Printf("Error: %s", err)
+		}
+		// Building may have read the mmkfiles of subdirectories.
+		for _, p := range rs.sourceFiles() {
+			if _, ok := mmkfiles[p]; !ok {
+				mmkfiles[p] = modTime(p)
+			}
+		}
+		paths := append(keys(mmkfiles), keys(sources)...)
+		if err := w.Watch(paths); err != nil {
+			return err
+		}
+		log.Printf("Watching %d files for changes", len(paths))
+		waitForChanges(w.Changes(), watchQuiet)
+		if len(changedFiles(mmkfiles, snapshot(keys(mmkfiles)))) == 0 {
+			continue
+		}
+		nrs, err := ParseOptions(file, opts)
+		if err != nil {
+			// Keep building with the old rules until the mmkfile is
+			// fixed.
+			log.Printf("Error: %s", err)
+			mmkfiles = snapshot(keys(mmkfiles))
+			continue
+		}
+		rs = nrs
+		mmkfiles = snapshot(rs.sourceFiles())
+		sources = nil
+	}
+}
+
+// rebuild builds goals again. sources holds the modification times of the
+// source files of the last graph built, or is nil if there is none, in
+// which case every goal is built. Otherwise only the targets depending on
+// source files that changed are built. It is updated for the new graph.
+func (r *RuleSets) rebuild(goals []Goal, sources *map[string]time.Time, njobs int) error {
+	g, err := GenerateGraphForGoals(r, goals)
+	if err != nil {
+		return err
+	}
+	current := snapshot(g.sources())
+	previous := *sources
+	*sources = current
+	if previous == nil {
+		err = g.Execute(njobs)
+	} else {
+		changed := changedFiles(previous, current)
+		if len(changed) == 0 {
+			return nil
+		}
+		log.Printf("Changed: %s", strings.Join(changed, " "))
+		err = g.executeAffected(changed, njobs)
+	}
+	// Depfiles read during the build may have named new sources.
+	for _, p := range g.discovered() {
+		if _, ok := current[p]; !ok {
+			current[p] = modTime(p)
+		}
+	}
+	return err
+}
+
+// sources returns the paths of the graph's source files, the existing
+// files that no rule makes.
+func (g *Graph) sources() []string {
+	var paths []string
+	for _, n := range g.uniqueNodes() {
+		if n.source {
+			paths = append(paths, n.path())
+		}
+	}
+	return paths
+}
+
+// discovered returns the paths of the existing files that the graph's
+// nodes were found to depend on by reading depfiles.
+func (g *Graph) discovered() []string {
+	var paths []string
+	for _, n := range g.uniqueNodes() {
+		if n.RuleSet.SelectBody(n.RuleType).Depfile == "" {
+			continue
+		}
+		for _, d := range loadState().deps(n.key()) {
+			if p := n.pathOf(d); fileExists(p) {
+				paths = append(paths, p)
+			}
+		}
+	}
+	return paths
+}
+
+// uniqueNodes returns each of the graph's nodes once.
+func (g *Graph) uniqueNodes() []*Node {
+	seen := make(map[*Node]struct{})
+	var ns []*Node
+	for _, n := range g.nodes {
+		if _, ok := seen[n]; ok {
+			continue
+		}
+		seen[n] = struct{}{}
+		ns = append(ns, n)
+	}
+	return ns
+}
+
+// executeAffected builds the nodes of the graph that depend on the source
+// files at paths. The others are treated as already built.
+func (g *Graph) executeAffected(paths []string, njobs int) error {
+	changed := make(map[string]struct{})
+	for _, p := range paths {
+		changed[p] = struct{}{}
+	}
+	affected := make(map[*Node]struct{})
+	var mark func(n *Node)
+	mark = func(n *Node) {
+		if _, ok := affected[n]; ok {
+			return
+		}
+		affected[n] = struct{}{}
+		for _, in := range n.Incoming {
+			mark(in)
+		}
+	}
+	for _, n := range g.uniqueNodes() {
+		if _, ok := changed[n.path()]; ok && n.source {
+			mark(n)
+		}
+	}
+	var roots []*Node
+	for _, n := range g.uniqueNodes() {
+		if _, ok := affected[n]; !ok {
+			n.queued = true
+			close(n.built)
+			continue
+		}
+		root := true
+		for _, out := range n.Outgoing {
+			if _, ok := affected[out]; ok {
+				root = false
+				break
+			}
+		}
+		if root {
+			roots = append(roots, n)
+		}
+	}
+	return Execute(roots, njobs)
+}
+
+// waitForChanges waits for a value on c, and then until no more arrive
+// for quiet.
+func waitForChanges(c <-chan struct{}, quiet time.Duration) {
+	<-c
+	for {
+		select {
+		case <-c:
+		case <-time.After(quiet):
+			return
+		}
+	}
+}
+
+// snapshot returns the modification times of the files at paths. Files
+// that do not exist have the zero time.
+func snapshot(paths []string) map[string]time.Time {
+	times := make(map[string]time.Time)
+	for _, p := range paths {
+		times[p] = modTime(p)
+	}
+	return times
+}
+
+// changedFiles returns the files in current whose modification times
+// differ from those in previous, or that are not in previous, in sorted
+// order.
+func changedFiles(previous, current map[string]time.Time) []string {
+	var changed []string
+	for p, t := range current {
+		if pt, ok := previous[p]; !ok || !pt.Equal(t) {
+			changed = append(changed, p)
+		}
+	}
+	sort.Strings(changed)
+	return changed
+}
+
+func keys(times map[string]time.Time) []string {
+	var ks []string
+	for k := range times {
+		ks = append(ks, k)
+	}
+	return ks
+}
+
+// A poller is a watcher that checks the modification times of its files
+// at an interval. It is used where inotify is not available.
+type poller struct {
+	sync.Mutex
+	times   map[string]time.Time
+	changes chan struct{}
+	done    chan struct{}
+}
+
+func newPoller(interval time.Duration) *poller {
+	p := &poller{
+		times:   make(map[string]time.Time),
+		changes: make(chan struct{}, 1),
+		done:    make(chan struct{}),
+	}
+	go func() {
+		t := time.NewTicker(interval)
+		defer t.Stop()
+		for {
+			select {
+			case <-p.done:
+				return
+			case <-t.C:
+				p.poll()
+			}
+		}
+	}()
+	return p
+}
+
+func (p *poller) poll() {
+	p.Lock()
+	defer p.Unlock()
+	for path, t := range p.times {
+		if mt := modTime(path); !mt.Equal(t) {
+			p.times[path] = mt
+			select {
+			case p.changes <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
+
+func (p *poller) Watch(paths []string) error {
+	p.Lock()
+	defer p.Unlock()
+	p.times = snapshot(paths)
+	return nil
+}
+
+func (p *poller) Changes() <-chan struct{} {
+	return p.changes
+}
+
+func (p *poller) Close() error {
+	close(p.done)
+	return nil
+}
@@ -0,0 +1,181 @@
+//go:build linux
+// +build linux
+
+package mmk
+
+import (
+	"bytes"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// inotifyEvents are the events that may mean a file in a watched
+// directory changed. Editors often save by writing a new file and renaming
+// it over the old one, so creation and renaming count as well.
+const inotifyEvents = syscall.IN_CLOSE_WRITE | syscall.IN_MODIFY | syscall.IN_ATTRIB |
+	syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MOVED_TO | syscall.IN_MOVED_FROM
+
+// An inotifyWatcher watches files with inotify. It watches the
+// directories containing the files, so that files which are replaced
+// rather than written to are still seen.
+type inotifyWatcher struct {
+	sync.Mutex
+	fd int
+	// epfd waits for events on fd, or for stop to be closed.
+	epfd int
+	// stop is the pipe closed to stop the reader. stop[0] becomes
+	// readable once stop[1] is closed.
+	stop [2]int
+	done chan struct{}
+	// dirs holds the watched directories, by watch descriptor.
+	dirs map[int32]string
+	// watched holds the directories being watched.
+	watched map[string]struct{}
+	// files holds the files whose changes are reported.
+	files   map[string]struct{}
+	changes chan struct{}
+}
+
+func newWatcher() (watcher, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, err
+	}
+	w := &inotifyWatcher{
+		fd:      fd,
+		done:    make(chan struct{}),
+		dirs:    make(map[int32]string),
+		watched: make(map[string]struct{}),
+		files:   make(map[string]struct{}),
+		changes: make(chan struct{}, 1),
+	}
+	if err := syscall.Pipe2(w.stop[:], syscall.O_CLOEXEC); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	w.epfd, err = syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err == nil {
+		err = w.poll(fd)
+	}
+	if err == nil {
+		err = w.poll(w.stop[0])
+	}
+	if err != nil {
+		w.closeAll()
+		syscall.Close(w.stop[1])
+		return nil, err
+	}
+	go w.read()
+	return w, nil
+}
+
+// poll adds fd to the descriptors waited for by w.epfd.
+func (w *inotifyWatcher) poll(fd int) error {
+	ev := syscall.EpollEvent{Events: syscall.EPOLLIN, Fd: int32(fd)}
+	return syscall.EpollCtl(w.epfd, syscall.EPOLL_CTL_ADD, fd, &ev)
+}
+
+// closeAll closes the watcher's descriptors, except the writing end of
+// stop, which is closed by Close.
+func (w *inotifyWatcher) closeAll() {
+	for _, fd := range []int{w.fd, w.epfd, w.stop[0]} {
+		if fd >= 0 {
+			syscall.Close(fd)
+		}
+	}
+}
+
+// read reads events until the watcher is closed, and reports those for
+// watched files on w.changes.
+func (w *inotifyWatcher) read() {
+	defer close(w.done)
+	defer w.closeAll()
+	buf := make([]byte, 64*(syscall.SizeofInotifyEvent+syscall.NAME_MAX+1))
+	events := make([]syscall.EpollEvent, 2)
+	for {
+		n, err := syscall.EpollWait(w.epfd, events, -1)
+		if err == syscall.EINTR {
+			continue
+		}
+		if err != nil {
+			return
+		}
+		for _, ev := range events[:n] {
+			if int(ev.Fd) == w.stop[0] {
+				return
+			}
+		}
+		n, err = syscall.Read(w.fd, buf)
+		if err == syscall.EINTR || err == syscall.EAGAIN {
+			continue
+		}
+		if err != nil || n <= 0 {
+			return
+		}
+		for off := 0; off+syscall.SizeofInotifyEvent <= n; {
+			ev := (*syscall.InotifyEvent)(unsafe.Pointer(&buf[off]))
+			start := off + syscall.SizeofInotifyEvent
+			name := string(bytes.TrimRight(buf[start:start+int(ev.Len)], "\x00"))
+			off = start + int(ev.Len)
+			if ev.Mask&syscall.IN_Q_OVERFLOW != 0 {
+				// Events were lost, so anything may have changed.
+				w.notify()
+				continue
+			}
+			w.Lock()
+			dir, ok := w.dirs[ev.Wd]
+			_, watched := w.files[filepath.Join(dir, name)]
+			w.Unlock()
+			if ok && watched {
+				w.notify()
+			}
+		}
+	}
+}
+
+func (w *inotifyWatcher) notify() {
+	select {
+	case w.changes <- struct{}{}:
+	default:
+	}
+}
+
+func (w *inotifyWatcher) Watch(paths []string) error {
+	w.Lock()
+	defer w.Unlock()
+	w.files = make(map[string]struct{})
+	for _, p := range paths {
+		p = filepath.Clean(p)
+		w.files[p] = struct{}{}
+		dir := filepath.Dir(p)
+		if _, ok := w.watched[dir]; ok {
+			continue
+		}
+		wd, err := syscall.InotifyAddWatch(w.fd, dir, inotifyEvents)
+		if err == syscall.ENOENT {
+			// The directory may be made later. Until then, its files
+			// cannot change.
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		w.dirs[int32(wd)] = dir
+		w.watched[dir] = struct{}{}
+	}
+	return nil
+}
+
+func (w *inotifyWatcher) Changes() <-chan struct{} {
+	return w.changes
+}
+
+// Close stops the reader, which closes the other descriptors, and waits
+// for it to return.
+func (w *inotifyWatcher) Close() error {
+	err := syscall.Close(w.stop[1])
+	<-w.done
+	return err
+}
@@ -0,0 +1,12 @@
+//go:build !linux
+// +build !linux
+
+package mmk
+
+import "errors"
+
+// newWatcher fails where inotify is not available, so that files are
+// polled instead.
+func newWatcher() (watcher, error) {
+	return nil, errors.New("inotify is only available on Linux")
+}